@@ -0,0 +1,158 @@
+// Package admin serves metrics and a JSON API for managing live sessions,
+// meant for a listener kept apart from proxy traffic.
+//
+// The API is:
+//
+//	GET    /sessions          list live sessions, filtered by ?user= if given
+//	GET    /sessions/ID       show one session
+//	DELETE /sessions/ID       close one session
+//	DELETE /sessions?user=U   close every session for a user
+//
+// With a token, every request must send it as "Authorization: Bearer
+// TOKEN".
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/beefsack/go-under-cover/llog"
+	"github.com/beefsack/go-under-cover/metrics"
+	"github.com/beefsack/go-under-cover/session"
+)
+
+var logger = llog.Named("admin")
+
+// ErrNoToken is returned when serving on an address other than loopback
+// without a token, which would let anyone on the network close sessions.
+var ErrNoToken = errors.New("admin: a token is required to listen on a non-loopback address")
+
+// Handler serves the API, requiring token if it isn't empty.
+func Handler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default)
+	api := &api{sessions: session.Default}
+	mux.HandleFunc("/sessions", api.handleSessions)
+	mux.HandleFunc("/sessions/", api.handleSession)
+	if token == "" {
+		return mux
+	}
+	return requireToken(token, mux)
+}
+
+func ListenAndServe(addr, token string) error {
+	if token == "" && !IsLoopback(addr) {
+		return ErrNoToken
+	}
+	return http.ListenAndServe(addr, Handler(token))
+}
+
+// IsLoopback reports whether addr only listens on a loopback interface. An
+// empty host listens on every interface, so isn't.
+func IsLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			logger.Warn("refusing admin request from %s without a valid token", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type api struct {
+	sessions *session.Registry
+}
+
+func (a *api) handleSessions(w http.ResponseWriter, r *http.Request) {
+	users, byUser := r.URL.Query()["user"]
+	switch r.Method {
+	case http.MethodGet:
+		infos := a.sessions.List()
+		if byUser {
+			filtered := []session.Info{}
+			for _, info := range infos {
+				if info.User == users[0] {
+					filtered = append(filtered, info)
+				}
+			}
+			infos = filtered
+		}
+		writeJSON(w, http.StatusOK, infos)
+	case http.MethodDelete:
+		// Closing everything by accident would be too easy without
+		// requiring a user.
+		if !byUser {
+			writeError(w, http.StatusBadRequest, errors.New("user is required"))
+			return
+		}
+		n := a.sessions.CloseUser(users[0])
+		logger.Info("closed %d sessions for user %q from admin API", n, users[0])
+		writeJSON(w, http.StatusOK, map[string]int{"closed": n})
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func (a *api) handleSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/sessions/"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusNotFound, session.ErrNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		for _, info := range a.sessions.List() {
+			if info.ID == id {
+				writeJSON(w, http.StatusOK, info)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, session.ErrNotFound)
+	case http.MethodDelete:
+		if err := a.sessions.Close(id); err == session.ErrNotFound {
+			writeError(w, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			logger.Debug("error closing session %d: %v", id, err)
+		}
+		logger.Info("closed session %d from admin API", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Debug("failed to write admin response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
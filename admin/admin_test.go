@@ -0,0 +1,67 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsLoopback(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1:9090", true},
+		{"127.0.0.2:9090", true},
+		{"[::1]:9090", true},
+		{"localhost:9090", true},
+		{":9090", false},
+		{"0.0.0.0:9090", false},
+		{"[::]:9090", false},
+		{"192.168.1.1:9090", false},
+		{"admin.example:9090", false},
+		{"127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := IsLoopback(tt.addr); got != tt.want {
+			t.Errorf("IsLoopback(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestListenAndServeRequiresToken(t *testing.T) {
+	if err := ListenAndServe(":0", ""); err != ErrNoToken {
+		t.Errorf("got %v, want ErrNoToken", err)
+	}
+}
+
+func TestToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		want   int
+	}{
+		{"no token configured", "", "", http.StatusOK},
+		{"missing", "secret", "", http.StatusUnauthorized},
+		{"wrong", "secret", "Bearer nope", http.StatusUnauthorized},
+		{"not bearer", "secret", "Basic secret", http.StatusUnauthorized},
+		{"correct", "secret", "Bearer secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := Handler(tt.token)
+			for _, path := range []string{"/sessions", "/metrics"} {
+				r := httptest.NewRequest(http.MethodGet, path, nil)
+				if tt.header != "" {
+					r.Header.Set("Authorization", tt.header)
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				if w.Code != tt.want {
+					t.Errorf("GET %s returned %d, want %d", path, w.Code, tt.want)
+				}
+			}
+		})
+	}
+}
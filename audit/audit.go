@@ -0,0 +1,92 @@
+// Package audit writes a record of every proxied session once it ends, for
+// keeping a durable log of who connected where.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/beefsack/go-under-cover/llog"
+	"github.com/beefsack/go-under-cover/session"
+)
+
+var logger = llog.Named("audit")
+
+type Record struct {
+	User         string    `json:"user"`
+	Source       string    `json:"source"`
+	Kind         string    `json:"kind"`
+	SocksVersion string    `json:"socks_version,omitempty"`
+	Destination  string    `json:"destination"`
+	ResolvedIP   string    `json:"resolved_ip,omitempty"`
+	Transport    string    `json:"transport"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	BytesUp      int64     `json:"bytes_up"`
+	BytesDown    int64     `json:"bytes_down"`
+	Reason       string    `json:"reason"`
+}
+
+func NewRecord(info session.Info, end time.Time, reason string) *Record {
+	return &Record{
+		User:         info.User,
+		Source:       info.Source,
+		Kind:         info.Kind,
+		SocksVersion: info.SocksVersion,
+		Destination:  info.Destination,
+		ResolvedIP:   info.ResolvedIP,
+		Transport:    info.Transport,
+		Start:        info.Start,
+		End:          end,
+		BytesUp:      info.BytesUp,
+		BytesDown:    info.BytesDown,
+		Reason:       reason,
+	}
+}
+
+// Sink stores audit records.
+type Sink interface {
+	Write(r *Record) error
+}
+
+// Hook returns a session.Registry OnDone function which writes a record for
+// each session to sink.
+func Hook(sink Sink) func(info session.Info, reason string) {
+	return func(info session.Info, reason string) {
+		if err := sink.Write(NewRecord(info, time.Now(), reason)); err != nil {
+			logger.Error("failed to write audit record: %v", err)
+		}
+	}
+}
+
+// NewWriterSink writes records to w as JSON lines.
+func NewWriterSink(w io.Writer) Sink {
+	return &writerSink{w: w}
+}
+
+type writerSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *writerSink) Write(r *Record) error {
+	line, err := encode(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(line)
+	return err
+}
+
+func encode(r *Record) ([]byte, error) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode audit record: %v", err)
+	}
+	return append(line, '\n'), nil
+}
@@ -0,0 +1,133 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileSink writes records to a file as JSON lines, moving it aside once it
+// reaches a size or age so it doesn't grow forever.
+type FileSink struct {
+	path string
+	// maxSize is the size in bytes to rotate at, and maxAge the age. Either
+	// is disabled if zero.
+	maxSize int64
+	maxAge  time.Duration
+	// rename moves the file aside when rotating.
+	rename func(oldpath, newpath string) error
+
+	mu sync.Mutex
+	// f is nil after a failed rotation, until it is reopened by the next
+	// Write.
+	f      *os.File
+	size   int64
+	opened time.Time
+	closed bool
+}
+
+func NewFileSink(path string, maxSize int64, maxAge time.Duration) (*FileSink, error) {
+	s := &FileSink{
+		path:    path,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		rename:  os.Rename,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat audit log: %v", err)
+	}
+	s.f = f
+	s.size = info.Size()
+	s.opened = time.Now()
+	return nil
+}
+
+func (s *FileSink) Write(r *Record) error {
+	line, err := encode(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return os.ErrClosed
+	}
+	if s.f == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.shouldRotate(int64(len(line))) {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %v", err)
+	}
+	return nil
+}
+
+func (s *FileSink) shouldRotate(n int64) bool {
+	if s.size == 0 {
+		return false
+	}
+	return (s.maxSize > 0 && s.size+n > s.maxSize) ||
+		(s.maxAge > 0 && time.Since(s.opened) >= s.maxAge)
+}
+
+// rotate renames the current file with a timestamp suffix and starts a new
+// one. Failing to close the old file doesn't stop a new one being opened.
+func (s *FileSink) rotate() error {
+	if err := s.closeFile(); err != nil {
+		logger.Error("%v", err)
+	}
+	s.f = nil
+	rotated := s.path + "." + time.Now().Format("20060102-150405.000000000")
+	if err := s.rename(s.path, rotated); err != nil {
+		// Keep writing to the same file rather than losing records.
+		logger.Warn("failed to rotate audit log: %v", err)
+	}
+	return s.open()
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.f == nil {
+		return nil
+	}
+	err := s.closeFile()
+	s.f = nil
+	return err
+}
+
+// closeFile syncs the file before closing it, so records written before a
+// rotation or shutdown aren't lost if the machine goes down.
+func (s *FileSink) closeFile() error {
+	if err := s.f.Sync(); err != nil {
+		s.f.Close()
+		return fmt.Errorf("failed to sync audit log: %v", err)
+	}
+	if err := s.f.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log: %v", err)
+	}
+	return nil
+}
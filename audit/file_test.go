@@ -0,0 +1,149 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readRecords reads every record from the audit log and its rotated files,
+// returning how many files there were.
+func readRecords(t *testing.T, path string) ([]*Record, int) {
+	t.Helper()
+	files, err := filepath.Glob(path + "*")
+	if err != nil {
+		t.Fatalf("failed to list audit logs: %v", err)
+	}
+	var records []*Record
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", file, err)
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			r := &Record{}
+			if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+				t.Fatalf("failed to decode %q: %v", scanner.Text(), err)
+			}
+			records = append(records, r)
+		}
+		f.Close()
+	}
+	return records, len(files)
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	recordSize := int64(len(mustEncode(t, &Record{User: "alice"})))
+	tests := []struct {
+		name      string
+		maxSize   int64
+		maxAge    time.Duration
+		wait      time.Duration
+		rename    func(oldpath, newpath string) error
+		wantFiles int
+	}{
+		{"no limits", 0, 0, 0, nil, 1},
+		{"size", recordSize * 2, 0, 0, nil, 2},
+		{"age", 0, 20 * time.Millisecond, 30 * time.Millisecond, nil, 3},
+		{"failed rename", recordSize, 0, 0, func(oldpath, newpath string) error {
+			return errors.New("rename failed")
+		}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			s, err := NewFileSink(path, tt.maxSize, tt.maxAge)
+			if err != nil {
+				t.Fatalf("NewFileSink: %v", err)
+			}
+			if tt.rename != nil {
+				s.rename = tt.rename
+			}
+			for i := 0; i < 3; i++ {
+				if err := s.Write(&Record{User: "alice"}); err != nil {
+					t.Fatalf("Write: %v", err)
+				}
+				time.Sleep(tt.wait)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			records, files := readRecords(t, path)
+			if len(records) != 3 {
+				t.Errorf("got %d records, want 3", len(records))
+			}
+			if files != tt.wantFiles {
+				t.Errorf("got %d files, want %d", files, tt.wantFiles)
+			}
+		})
+	}
+}
+
+func TestFileSinkReopensAfterFailedRotation(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "audit")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "audit.log")
+	s, err := NewFileSink(path, 1, 0)
+	if err != nil {
+		t.Fatalf("NewFileSink: %v", err)
+	}
+	defer s.Close()
+	if err := s.Write(&Record{User: "alice"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	// Without the directory the rotated file can't be opened.
+	os.RemoveAll(dir)
+	if err := s.Write(&Record{User: "bob"}); err == nil {
+		t.Fatal("Write succeeded without the directory")
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(&Record{User: "carol"}); err != nil {
+		t.Fatalf("Write after the directory returned: %v", err)
+	}
+	records, _ := readRecords(t, path)
+	if len(records) != 1 || records[0].User != "carol" {
+		t.Errorf("got %+v, want carol's record", records)
+	}
+}
+
+func TestFileSinkClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	s, err := NewFileSink(path, 0, 0)
+	if err != nil {
+		t.Fatalf("NewFileSink: %v", err)
+	}
+	if err := s.Write(&Record{User: "alice", Reason: "eof"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+	if err := s.Write(&Record{User: "bob"}); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Write after Close returned %v, want os.ErrClosed", err)
+	}
+	records, _ := readRecords(t, path)
+	if len(records) != 1 || records[0].User != "alice" || records[0].Reason != "eof" {
+		t.Errorf("got %+v, want alice's record", records)
+	}
+}
+
+func mustEncode(t *testing.T, r *Record) []byte {
+	t.Helper()
+	line, err := encode(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return line
+}
@@ -1,18 +1,218 @@
+// Package bridge copies data both ways between two connections until both
+// directions have finished.
 package bridge
 
-import "io"
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
 
-func Bridge(rw1, rw2 io.ReadWriter) error {
-	var err error
-	quit := make(chan struct{}, 1)
+	"github.com/beefsack/go-under-cover/llog"
+)
+
+var logger = llog.Named("bridge")
+
+const (
+	// DefaultLinger is how long the other direction may keep going once
+	// one has finished.
+	DefaultLinger = 2 * time.Minute
+	// DefaultIdleTimeout is how long a bridge may go without data in
+	// either direction.
+	DefaultIdleTimeout = 10 * time.Minute
+)
+
+// ErrIdleTimeout is the error for directions cut off by the idle timeout.
+var ErrIdleTimeout = errors.New("bridge: idle timeout")
+
+// ErrCloseWriteUnsupported is returned by CloseWrite for connections which
+// can't be half-closed.
+var ErrCloseWriteUnsupported = errors.New("bridge: CloseWrite not supported")
+
+type Options struct {
+	// Linger is how long to wait for the other direction once one has
+	// finished before closing both connections, forever if zero.
+	Linger time.Duration
+	// IdleTimeout closes both connections once nothing has been copied
+	// either way for this long, and is disabled if zero.
+	IdleTimeout time.Duration
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		Linger:      DefaultLinger,
+		IdleTimeout: DefaultIdleTimeout,
+	}
+}
+
+// Direction is what was copied one way across the bridge.
+type Direction struct {
+	Bytes int64
+	// Err is why copying stopped early, and is nil if it reached EOF or was
+	// cut off after lingering. It is ErrIdleTimeout or the context's error
+	// if those closed the bridge.
+	Err error
+}
+
+type Result struct {
+	// Sent is what was copied from rw1 to rw2, and Received from rw2 to
+	// rw1.
+	Sent, Received Direction
+}
+
+// Err returns the first error from either direction.
+func (r Result) Err() error {
+	if r.Sent.Err != nil {
+		return r.Sent.Err
+	}
+	return r.Received.Err
+}
+
+// Bridge copies between rw1 and rw2 until both directions are done. When
+// one side reaches EOF the other is half-closed with CloseWrite, so the peer
+// sees the EOF while data keeps flowing the other way. If it can't be
+// half-closed, a direction fails, the linger or idle timeout expires or ctx
+// is done, both sides are closed if they are io.Closers so the remaining
+// copy stops. Options may be nil to use the defaults.
+func Bridge(ctx context.Context, rw1, rw2 io.ReadWriter, opts *Options) Result {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	log := logger.WithContext(ctx)
+	var (
+		src1, src2 io.Reader = rw1, rw2
+		last       int64
+		idleTimer  *time.Timer
+		idle       <-chan time.Time
+	)
+	if opts.IdleTimeout > 0 {
+		// Reading is enough to count as activity, as everything read is
+		// then written.
+		atomic.StoreInt64(&last, time.Now().UnixNano())
+		src1 = &activityReader{rw1, &last}
+		src2 = &activityReader{rw2, &last}
+		idleTimer = time.NewTimer(opts.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	type copied struct {
+		sent bool
+		dir  Direction
+		// halfClosed is whether the destination was half-closed, without
+		// which the peer wouldn't see the EOF until both sides are closed.
+		halfClosed bool
+	}
+	done := make(chan copied, 2)
 	go func() {
-		_, err = io.Copy(rw1, rw2)
-		quit <- struct{}{}
+		dir, halfClosed := pipe(rw2, src1)
+		done <- copied{true, dir, halfClosed}
 	}()
 	go func() {
-		_, err = io.Copy(rw2, rw1)
-		quit <- struct{}{}
+		dir, halfClosed := pipe(rw1, src2)
+		done <- copied{false, dir, halfClosed}
 	}()
-	<-quit
-	return err
+
+	var (
+		res      Result
+		closed   bool
+		closeErr error
+		linger   <-chan time.Time
+		ctxDone  = ctx.Done()
+	)
+	closeBoth := func(err error) {
+		closed = true
+		closeErr = err
+		linger = nil
+		idle = nil
+		ctxDone = nil
+		closeIfCloser(rw1)
+		closeIfCloser(rw2)
+	}
+	for n := 0; n < 2; {
+		select {
+		case c := <-done:
+			n++
+			if closed {
+				// Errors after closing are only from the close.
+				c.dir.Err = closeErr
+			}
+			if c.sent {
+				res.Sent = c.dir
+			} else {
+				res.Received = c.dir
+			}
+			switch {
+			case n == 2 || closed:
+			case c.dir.Err != nil:
+				closeBoth(nil)
+			case !c.halfClosed:
+				log.Debug("closing as the other side can't be half-closed")
+				closeBoth(nil)
+			case opts.Linger > 0:
+				timer := time.NewTimer(opts.Linger)
+				defer timer.Stop()
+				linger = timer.C
+			}
+		case <-linger:
+			log.Debug("closing after lingering for %s", opts.Linger)
+			closeBoth(nil)
+		case <-idle:
+			since := time.Since(time.Unix(0, atomic.LoadInt64(&last)))
+			if since < opts.IdleTimeout {
+				idleTimer.Reset(opts.IdleTimeout - since)
+				continue
+			}
+			log.Debug("closing after idling for %s", since)
+			closeBoth(ErrIdleTimeout)
+		case <-ctxDone:
+			log.Debug("closing: %v", ctx.Err())
+			closeBoth(ctx.Err())
+		}
+	}
+	return res
+}
+
+// CloseWrite half-closes rw if it has a CloseWrite method. Wrappers can use
+// it to pass CloseWrite on to what they wrap.
+func CloseWrite(rw interface{}) error {
+	if cw, ok := rw.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return ErrCloseWriteUnsupported
+}
+
+// pipe copies src to dst, half-closing dst at EOF and reporting whether it
+// could.
+func pipe(dst io.Writer, src io.Reader) (Direction, bool) {
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		return Direction{Bytes: n, Err: err}, false
+	}
+	cerr := CloseWrite(dst)
+	if cerr == ErrCloseWriteUnsupported {
+		return Direction{Bytes: n}, false
+	}
+	return Direction{Bytes: n, Err: cerr}, cerr == nil
+}
+
+// activityReader records when it last read anything.
+type activityReader struct {
+	r    io.Reader
+	last *int64
+}
+
+func (a *activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(a.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func closeIfCloser(rw io.ReadWriter) {
+	if c, ok := rw.(io.Closer); ok {
+		c.Close()
+	}
 }
@@ -0,0 +1,157 @@
+package bridge
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection, which can be
+// half-closed.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	b := <-accepted
+	if b == nil {
+		t.Fatal("failed to accept")
+	}
+	return a, b
+}
+
+func pipePair(t *testing.T) (net.Conn, net.Conn) {
+	return net.Pipe()
+}
+
+// bridged bridges two pairs of connections, returning the outer ends and the
+// result once the bridge finishes.
+func bridged(
+	t *testing.T,
+	ctx context.Context,
+	pair1, pair2 func(*testing.T) (net.Conn, net.Conn),
+	opts *Options,
+) (net.Conn, net.Conn, <-chan Result) {
+	c1, b1 := pair1(t)
+	b2, c2 := pair2(t)
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	res := make(chan Result, 1)
+	go func() {
+		res <- Bridge(ctx, b1, b2, opts)
+	}()
+	return c1, c2, res
+}
+
+func waitResult(t *testing.T, res <-chan Result) Result {
+	t.Helper()
+	select {
+	case r := <-res:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("bridge didn't finish")
+	}
+	return Result{}
+}
+
+func TestHalfClose(t *testing.T) {
+	c1, c2, res := bridged(t, context.Background(), tcpPair, tcpPair, &Options{})
+
+	io.WriteString(c1, "request")
+	c1.(*net.TCPConn).CloseWrite()
+	got, err := ioutil.ReadAll(c2)
+	if err != nil || string(got) != "request" {
+		t.Fatalf("read %q, %v through the bridge", got, err)
+	}
+	// The other direction keeps going after the first is half-closed.
+	io.WriteString(c2, "response")
+	c2.(*net.TCPConn).CloseWrite()
+	got, err = ioutil.ReadAll(c1)
+	if err != nil || string(got) != "response" {
+		t.Fatalf("read %q, %v back through the bridge", got, err)
+	}
+
+	r := waitResult(t, res)
+	if r.Err() != nil {
+		t.Errorf("bridge failed: %v", r.Err())
+	}
+	if r.Sent.Bytes != int64(len("request")) || r.Received.Bytes != int64(len("response")) {
+		t.Errorf("sent %d and received %d bytes", r.Sent.Bytes, r.Received.Bytes)
+	}
+}
+
+func TestClose(t *testing.T) {
+	tests := []struct {
+		name    string
+		pair    func(*testing.T) (net.Conn, net.Conn)
+		opts    *Options
+		cancel  bool
+		eof     bool
+		wantErr error
+	}{
+		// Without CloseWrite the destination can't see the EOF, so both
+		// sides are closed rather than lingering.
+		{"close write unsupported", pipePair, &Options{Linger: time.Hour}, false, true, nil},
+		{"linger", tcpPair, &Options{Linger: 50 * time.Millisecond}, false, true, nil},
+		{"idle timeout", tcpPair, &Options{IdleTimeout: 50 * time.Millisecond}, false, false, ErrIdleTimeout},
+		{"context done", tcpPair, &Options{}, true, false, context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			c1, c2, res := bridged(t, ctx, tcpPair, tt.pair, tt.opts)
+			go io.Copy(ioutil.Discard, c2)
+			if tt.eof {
+				c1.(*net.TCPConn).CloseWrite()
+			}
+			if tt.cancel {
+				cancel()
+			}
+			r := waitResult(t, res)
+			if r.Err() != tt.wantErr {
+				t.Errorf("bridge finished with %v, want %v", r.Err(), tt.wantErr)
+			}
+			// The remaining direction was cut off, so c1 sees EOF.
+			c1.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := c1.Read(make([]byte, 1)); err != io.EOF {
+				t.Errorf("read %v after the bridge closed, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestIdleTimeoutReset(t *testing.T) {
+	c1, c2, res := bridged(t, context.Background(), tcpPair, tcpPair, &Options{
+		IdleTimeout: 100 * time.Millisecond,
+	})
+	go io.Copy(ioutil.Discard, c2)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		time.Sleep(50 * time.Millisecond)
+		io.WriteString(c1, "ping")
+	}
+	r := waitResult(t, res)
+	if r.Err() != ErrIdleTimeout {
+		t.Errorf("bridge finished with %v, want ErrIdleTimeout", r.Err())
+	}
+	if since := time.Since(start); since < 300*time.Millisecond {
+		t.Errorf("bridge timed out after %s despite traffic", since)
+	}
+}
@@ -1,34 +1,270 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/beefsack/go-under-cover/admin"
+	"github.com/beefsack/go-under-cover/audit"
+	"github.com/beefsack/go-under-cover/bridge"
+	"github.com/beefsack/go-under-cover/config"
 	"github.com/beefsack/go-under-cover/llog"
+	"github.com/beefsack/go-under-cover/route"
+	"github.com/beefsack/go-under-cover/session"
 	"github.com/beefsack/go-under-cover/socks"
 	"github.com/beefsack/go-under-cover/transport"
+	"github.com/beefsack/go-under-cover/undercover"
 )
 
+var logger = llog.Named("client")
+
+// auditDrainTimeout is how long sessions closed by shutting down have to
+// write their audit records.
+const auditDrainTimeout = 5 * time.Second
+
 func main() {
+	args := os.Args[1:]
+	validate := len(args) > 0 && args[0] == "validate"
+	if validate {
+		args = args[1:]
+	}
 	var (
-		listenAddr string
-		logLevel   int
+		configFile string
+		cfg        = config.DefaultClient()
+		socks4IDs  string
 	)
-	flag.StringVar(&listenAddr, "listen", ":1080", "the local address to listen on")
-	flag.IntVar(&logLevel, "v", llog.LevelInfo, "the level to log, 1-5")
-	flag.Parse()
-	args := flag.Args()
-	if len(args) == 0 {
-		llog.Fatal("you must specify the server address to proxy to")
-	}
-	llog.Default.Level = logLevel
-	trans := transport.NewWSSPlain(args[0])
-
-	llog.Info("listening on %s", listenAddr)
-	if err := socks.Listen(
-		&socks.Socks45{},
-		listenAddr,
-		socksHandler(trans),
-	); err != nil {
-		llog.Fatal("failed to listen: %s", err)
+	flag.StringVar(&configFile, "config", "", "a YAML config file, any flags given override it")
+	flag.StringVar(&cfg.Listen, "listen", cfg.Listen, "the local address to listen on for SOCKS and HTTP proxy requests")
+	flag.IntVar(&cfg.Log.Level, "v", cfg.Log.Level, "the level to log, 1-5")
+	flag.StringVar(&cfg.Log.Format, "log-format", cfg.Log.Format, "the log format, text or json")
+	flag.DurationVar(&cfg.Timeouts.Handshake, "handshake-timeout", cfg.Timeouts.Handshake, "how long SOCKS, HTTP and server handshakes may take, forever if 0")
+	flag.DurationVar(&cfg.Timeouts.Dial, "dial-timeout", cfg.Timeouts.Dial, "how long connecting directly to a destination may take, forever if 0")
+	flag.DurationVar(&cfg.Timeouts.Idle, "idle-timeout", cfg.Timeouts.Idle, "how long a connection may go without traffic, forever if 0")
+	flag.DurationVar(&cfg.Timeouts.Linger, "linger", cfg.Timeouts.Linger, "how long to keep a half-closed connection open, forever if 0")
+	flag.StringVar(&cfg.Audit.File, "audit", "", "a file to write a JSON record of every session to")
+	flag.StringVar(&cfg.Admin, "admin", "", "an address to serve /metrics and the session API on")
+	flag.StringVar(&cfg.AdminToken, "admin-token", "", "a bearer token the admin API requires, needed unless -admin is loopback")
+	flag.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "how long to wait for connections to finish on SIGTERM")
+	flag.StringVar(&cfg.Server.Fingerprint, "fingerprint", "", "the SHA-256 fingerprint of the server certificate to pin")
+	flag.StringVar(&cfg.Server.CA, "ca", "", "a PEM CA bundle to verify the server certificate with instead of the system roots")
+	flag.StringVar(&cfg.Server.User, "user", "", "the user to authenticate to the server as")
+	flag.StringVar(&cfg.Server.Key, "key", "", "the key to authenticate to the server with")
+	flag.StringVar(&cfg.Auth.UsersFile, "users", "", "a file of user:password lines SOCKS5 and HTTP proxy clients must authenticate with")
+	flag.StringVar(&socks4IDs, "socks4-ids", "", "a comma separated list of SOCKS4 USERIDs to allow")
+	flag.StringVar(&cfg.Server.Path, "path", cfg.Server.Path, "the URL path of the server's tunnel endpoint")
+	flag.StringVar(&cfg.RulesFile, "rules", "", "a file of routing rules, reloaded on SIGHUP")
+	flag.CommandLine.Parse(args)
+	if configFile != "" {
+		flagCfg := cfg
+		var err error
+		if cfg, err = config.LoadClient(configFile); err != nil {
+			logger.Fatal("failed loading config: %v", err)
+		}
+		overrideClient(cfg, flagCfg)
+	}
+	if flag.NArg() > 0 {
+		cfg.Server.Address = flag.Arg(0)
+	}
+	if socks4IDs != "" {
+		cfg.Auth.Socks4IDs = strings.Split(socks4IDs, ",")
+	}
+	if err := cfg.Validate(); err != nil {
+		if validate {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		logger.Fatal("invalid config:\n%v", err)
+	}
+	if validate {
+		fmt.Println("config is valid")
+		return
+	}
+	cfg.Log.Apply()
+
+	transports := map[string]transport.Transport{
+		route.DefaultTransport: newTransport(&cfg.Server, cfg.Timeouts),
+	}
+	for name, t := range cfg.Transports {
+		transports[name] = newTransport(t, cfg.Timeouts)
+	}
+	router := route.NewRouter(transports)
+	router.Dialer.Timeout = cfg.Timeouts.Dial
+	if len(cfg.Rules) > 0 {
+		rules, err := cfg.ParseRules()
+		if err == nil {
+			err = router.SetRules(rules)
+		}
+		if err != nil {
+			logger.Fatal("failed loading rules: %v", err)
+		}
+	}
+	if cfg.RulesFile != "" {
+		if err := router.Load(cfg.RulesFile); err != nil {
+			logger.Fatal("failed loading rules: %v", err)
+		}
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			for range reload {
+				if err := router.Reload(); err != nil {
+					logger.Error("failed reloading rules: %v", err)
+				}
+			}
+		}()
+	}
+
+	opts := undercover.DefaultClientOptions()
+	opts.Listen = cfg.Listen
+	opts.Transport = router
+	opts.HandshakeTimeout = cfg.Timeouts.Handshake
+	opts.Bridge = &bridge.Options{
+		Linger:      cfg.Timeouts.Linger,
+		IdleTimeout: cfg.Timeouts.Idle,
+	}
+	opts.Logger = logger
+	if cfg.Auth.UsersFile != "" || len(cfg.Auth.Users) > 0 {
+		users := map[string]string{}
+		if cfg.Auth.UsersFile != "" {
+			var err error
+			if users, err = loadUsers(cfg.Auth.UsersFile); err != nil {
+				logger.Fatal("failed loading users: %v", err)
+			}
+		}
+		for user, pass := range cfg.Auth.Users {
+			users[user] = pass
+		}
+		opts.Credentials = socks.StaticCredentials(users)
+	}
+	if len(cfg.Auth.Socks4IDs) > 0 {
+		opts.AllowUserID = socks.AllowUserIDs(cfg.Auth.Socks4IDs...)
+	}
+
+	var sink *audit.FileSink
+	if cfg.Audit.File != "" {
+		var err error
+		if sink, err = audit.NewFileSink(cfg.Audit.File, cfg.Audit.MaxSize, cfg.Audit.MaxAge); err != nil {
+			logger.Fatal("failed to open audit log: %v", err)
+		}
+		session.Default.OnDone = audit.Hook(sink)
+	}
+	if cfg.Admin != "" {
+		go func() {
+			logger.Info("serving admin on %s", cfg.Admin)
+			if err := admin.ListenAndServe(cfg.Admin, cfg.AdminToken); err != nil {
+				logger.Fatal("failed to serve admin: %v", err)
+			}
+		}()
 	}
+
+	client := undercover.NewClient(opts)
+	if err := client.Start(context.Background()); err != nil {
+		logger.Fatal("%v", err)
+	}
+
+	shutdown := make(chan struct{})
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		logger.Info("received %s, shutting down", <-stop)
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := client.Shutdown(ctx); err != nil {
+			logger.Warn("failed to shut down cleanly: %v", err)
+		}
+		close(shutdown)
+	}()
+
+	if err := client.Wait(); err != nil {
+		logger.Fatal("%v", err)
+	}
+	<-shutdown
+	if sink != nil {
+		closeAudit(sink)
+	}
+}
+
+// closeAudit closes the audit log once the sessions still finishing after
+// shutdown have written their records.
+func closeAudit(sink *audit.FileSink) {
+	ctx, cancel := context.WithTimeout(context.Background(), auditDrainTimeout)
+	defer cancel()
+	if err := session.Default.Wait(ctx); err != nil {
+		logger.Warn("closing audit log with sessions still active: %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		logger.Warn("failed to close audit log: %v", err)
+	}
+}
+
+func newTransport(t *config.Transport, timeouts config.Timeouts) transport.Transport {
+	if t.Socks != 0 {
+		client := socks.NewClient(t.Address, byte(t.Socks))
+		client.Username = t.User
+		client.Password = t.Password
+		client.Dialer.Timeout = timeouts.Dial
+		client.HandshakeTimeout = timeouts.Handshake
+		return transport.NewSOCKS(client)
+	}
+	trans := transport.NewWSSPlain(t.Address)
+	trans.Path = t.Path
+	trans.Subprotocol = t.Subprotocol
+	trans.BufferSize = t.BufferSize
+	trans.Fingerprint = t.Fingerprint
+	trans.CAFile = t.CA
+	trans.User = t.User
+	trans.Key = []byte(t.Key)
+	trans.HandshakeTimeout = timeouts.Handshake
+	return trans
+}
+
+// overrideClient copies the values of flags which were given on the command
+// line from flagCfg over cfg.
+func overrideClient(cfg, flagCfg *config.Client) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = flagCfg.Listen
+		case "v":
+			cfg.Log.Level = flagCfg.Log.Level
+		case "log-format":
+			cfg.Log.Format = flagCfg.Log.Format
+		case "handshake-timeout":
+			cfg.Timeouts.Handshake = flagCfg.Timeouts.Handshake
+		case "dial-timeout":
+			cfg.Timeouts.Dial = flagCfg.Timeouts.Dial
+		case "idle-timeout":
+			cfg.Timeouts.Idle = flagCfg.Timeouts.Idle
+		case "linger":
+			cfg.Timeouts.Linger = flagCfg.Timeouts.Linger
+		case "audit":
+			cfg.Audit.File = flagCfg.Audit.File
+		case "admin":
+			cfg.Admin = flagCfg.Admin
+		case "admin-token":
+			cfg.AdminToken = flagCfg.AdminToken
+		case "shutdown-timeout":
+			cfg.ShutdownTimeout = flagCfg.ShutdownTimeout
+		case "fingerprint":
+			cfg.Server.Fingerprint = flagCfg.Server.Fingerprint
+		case "ca":
+			cfg.Server.CA = flagCfg.Server.CA
+		case "user":
+			cfg.Server.User = flagCfg.Server.User
+		case "key":
+			cfg.Server.Key = flagCfg.Server.Key
+		case "users":
+			cfg.Auth.UsersFile = flagCfg.Auth.UsersFile
+		case "path":
+			cfg.Server.Path = flagCfg.Server.Path
+		case "rules":
+			cfg.RulesFile = flagCfg.RulesFile
+			cfg.Rules = nil
+		}
+	})
 }
@@ -0,0 +1,177 @@
+package config
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/beefsack/go-under-cover/route"
+	"github.com/beefsack/go-under-cover/transport"
+	"gopkg.in/yaml.v3"
+)
+
+type Client struct {
+	Listen string `yaml:"listen"`
+	Log    Log    `yaml:"log"`
+	// ShutdownTimeout is how long to wait for connections to finish when
+	// stopping before closing them.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	Timeouts        Timeouts      `yaml:"timeouts"`
+	Audit           Audit         `yaml:"audit"`
+	// Admin is the address to serve /metrics and the session API on, if
+	// any.
+	Admin string `yaml:"admin"`
+	// AdminToken must be sent as a bearer token to use the admin API, and
+	// is required unless Admin is a loopback address.
+	AdminToken string `yaml:"admin_token"`
+	// Server is the default transport.
+	Server Transport `yaml:"server"`
+	// Transports are extra transports which rules can send traffic through
+	// by name.
+	Transports map[string]*Transport `yaml:"transports"`
+	Auth       ClientAuth            `yaml:"auth"`
+	// Rules are routing rules in the same form as a rules file. They can't
+	// be reloaded, so use RulesFile for that instead.
+	Rules     []string `yaml:"rules"`
+	RulesFile string   `yaml:"rules_file"`
+
+	doc *yaml.Node
+}
+
+type Transport struct {
+	Address     string `yaml:"address"`
+	Fingerprint string `yaml:"fingerprint"`
+	CA          string `yaml:"ca"`
+	User        string `yaml:"user"`
+	Key         string `yaml:"key"`
+	// Socks is 4 or 5 to use Address as an upstream SOCKS proxy instead of
+	// a server, logging in with User and Password.
+	Socks    int    `yaml:"socks"`
+	Password string `yaml:"password"`
+	Tunnel   `yaml:",inline"`
+}
+
+// ClientAuth configures who may use the local proxy.
+type ClientAuth struct {
+	Users     map[string]string `yaml:"users"`
+	UsersFile string            `yaml:"users_file"`
+	Socks4IDs []string          `yaml:"socks4_ids"`
+}
+
+func DefaultClient() *Client {
+	return &Client{
+		Listen:          ":1080",
+		Log:             defaultLog(),
+		ShutdownTimeout: DefaultShutdownTimeout,
+		Timeouts:        defaultTimeouts(),
+		Server: Transport{
+			Tunnel: defaultTunnel(),
+		},
+		Transports: map[string]*Transport{},
+	}
+}
+
+// LoadClient reads a client config file over the defaults.
+func LoadClient(path string) (*Client, error) {
+	c := DefaultClient()
+	doc, err := load(path, c)
+	if err != nil {
+		return nil, err
+	}
+	c.doc = doc
+	// Named transports aren't in the defaults, so fill in what they leave
+	// out.
+	def := defaultTunnel()
+	for _, t := range c.Transports {
+		if t == nil {
+			continue
+		}
+		if t.Path == "" {
+			t.Path = def.Path
+		}
+		if t.Subprotocol == "" {
+			t.Subprotocol = def.Subprotocol
+		}
+		if t.BufferSize == 0 {
+			t.BufferSize = def.BufferSize
+		}
+	}
+	return c, nil
+}
+
+func (c *Client) Validate() error {
+	v := &validator{doc: c.doc}
+	if c.Listen == "" {
+		v.errorf([]string{"listen"}, "listen address is required")
+	}
+	c.Log.validate(v, "log")
+	validateShutdownTimeout(v, c.ShutdownTimeout)
+	validateAdmin(v, c.Admin, c.AdminToken)
+	c.Timeouts.validate(v, "timeouts")
+	c.Audit.validate(v, "audit")
+	c.Server.validate(v, "server")
+	for name, t := range c.Transports {
+		if name == "" {
+			v.errorf([]string{"transports"}, "transport names can't be empty")
+		}
+		if t == nil {
+			v.errorf([]string{"transports", name}, "transport has no settings")
+			continue
+		}
+		t.validate(v, "transports", name)
+	}
+	if len(c.Rules) > 0 && c.RulesFile != "" {
+		v.errorf([]string{"rules"}, "only one of rules and rules_file may be set")
+	}
+	for i, line := range c.Rules {
+		rule, err := route.ParseRule(line)
+		if err != nil {
+			v.errorf([]string{"rules", strconv.Itoa(i)}, "%v", err)
+			continue
+		}
+		name := rule.Action.Transport
+		if _, ok := c.Transports[name]; rule.Action.Kind == route.ActionTunnel &&
+			name != route.DefaultTransport && !ok {
+			v.errorf([]string{"rules", strconv.Itoa(i)}, "unknown transport %q", name)
+		}
+	}
+	return v.err()
+}
+
+func (t *Transport) validate(v *validator, path ...string) {
+	if t.Address == "" {
+		v.errorf(append(path, "address"), "server address is required")
+	}
+	if t.Socks != 0 {
+		validateSocks(v, t.Socks, t.Password, path...)
+		return
+	}
+	if t.Password != "" {
+		v.errorf(append(path, "password"), "password is only used with socks")
+	}
+	if t.Fingerprint != "" {
+		if _, err := transport.ParseFingerprint(t.Fingerprint); err != nil {
+			v.errorf(append(path, "fingerprint"), "%v", err)
+		}
+	}
+	if t.User != "" && t.Key == "" {
+		v.errorf(append(path, "key"), "a key is required when a user is set")
+	}
+	t.Tunnel.validate(v, path...)
+}
+
+// ParseRules parses Rules, numbering them by the line they were set on.
+func (c *Client) ParseRules() ([]*route.Rule, error) {
+	rules := make([]*route.Rule, 0, len(c.Rules))
+	for i, line := range c.Rules {
+		rule, err := route.ParseRule(line)
+		if err != nil {
+			return nil, &Error{
+				Line: lineOf(c.doc, []string{"rules", strconv.Itoa(i)}),
+				Msg:  err.Error(),
+			}
+		}
+		rule.Line = lineOf(c.doc, []string{"rules", strconv.Itoa(i)})
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
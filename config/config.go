@@ -0,0 +1,267 @@
+// Package config loads and validates YAML configuration files for the client
+// and server.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beefsack/go-under-cover/admin"
+	"github.com/beefsack/go-under-cover/bridge"
+	"github.com/beefsack/go-under-cover/llog"
+	"github.com/beefsack/go-under-cover/transport"
+	"gopkg.in/yaml.v3"
+)
+
+// Error is a problem with a config value, at the line it was set on if it
+// came from a file.
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+	}
+	return e.Msg
+}
+
+type Errors []*Error
+
+func (errs Errors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+const (
+	DefaultShutdownTimeout = 30 * time.Second
+	DefaultDialTimeout     = 10 * time.Second
+)
+
+func validateShutdownTimeout(v *validator, timeout time.Duration) {
+	if timeout < 0 {
+		v.errorf([]string{"shutdown_timeout"}, "shutdown timeout can't be negative")
+	}
+}
+
+func validateAdmin(v *validator, addr, token string) {
+	if addr != "" && token == "" && !admin.IsLoopback(addr) {
+		v.errorf([]string{"admin"}, "admin_token is required to serve admin on %s, which isn't loopback", addr)
+	}
+}
+
+// Audit writes a JSON record of every session to File, if set. The file is
+// rotated once it reaches MaxSize bytes or MaxAge, unless they are zero.
+type Audit struct {
+	File    string        `yaml:"file"`
+	MaxSize int64         `yaml:"max_size"`
+	MaxAge  time.Duration `yaml:"max_age"`
+}
+
+func (a *Audit) validate(v *validator, path ...string) {
+	if a.MaxSize < 0 {
+		v.errorf(append(path, "max_size"), "max size can't be negative")
+	}
+	if a.MaxAge < 0 {
+		v.errorf(append(path, "max_age"), "max age can't be negative")
+	}
+}
+
+// Timeouts are disabled when zero.
+type Timeouts struct {
+	// Handshake limits SOCKS, TLS and WebSocket handshakes.
+	Handshake time.Duration `yaml:"handshake"`
+	// Dial limits connecting to destinations.
+	Dial time.Duration `yaml:"dial"`
+	// Idle closes connections once nothing has been sent either way for
+	// this long.
+	Idle time.Duration `yaml:"idle"`
+	// Linger is how long a connection may stay half-closed before both
+	// sides are closed.
+	Linger time.Duration `yaml:"linger"`
+}
+
+func defaultTimeouts() Timeouts {
+	return Timeouts{
+		Handshake: transport.DefaultHandshakeTimeout,
+		Dial:      DefaultDialTimeout,
+		Idle:      bridge.DefaultIdleTimeout,
+		Linger:    bridge.DefaultLinger,
+	}
+}
+
+func (t *Timeouts) validate(v *validator, path ...string) {
+	for key, d := range map[string]time.Duration{
+		"handshake": t.Handshake,
+		"dial":      t.Dial,
+		"idle":      t.Idle,
+		"linger":    t.Linger,
+	} {
+		if d < 0 {
+			v.errorf(append(path, key), "timeout can't be negative")
+		}
+	}
+}
+
+type Log struct {
+	Level int `yaml:"level"`
+	// Format is text or json.
+	Format string `yaml:"format"`
+	// Levels overrides the level of named loggers, such as socks or bridge.
+	Levels map[string]int `yaml:"levels"`
+}
+
+func defaultLog() Log {
+	return Log{
+		Level:  llog.LevelInfo,
+		Format: "text",
+	}
+}
+
+func (l *Log) validate(v *validator, path ...string) {
+	if l.Level < llog.LevelError || l.Level > llog.LevelTrace {
+		v.errorf(append(path, "level"), "log level must be 1-5, got %d", l.Level)
+	}
+	if l.Format != "text" && l.Format != "json" {
+		v.errorf(append(path, "format"), "log format must be text or json, got %q", l.Format)
+	}
+	for name, level := range l.Levels {
+		if level < llog.LevelError || level > llog.LevelTrace {
+			v.errorf(append(path, "levels", name), "log level must be 1-5, got %d", level)
+		}
+	}
+}
+
+// Apply configures llog.Default and the named loggers.
+func (l *Log) Apply() {
+	llog.Default.SetLevel(l.Level)
+	if l.Format == "json" {
+		llog.Default.SetSink(llog.NewJSONSink(os.Stderr))
+	}
+	llog.SetLevels(l.Levels)
+}
+
+// Tunnel holds the WebSocket settings shared by both ends of a transport.
+type Tunnel struct {
+	Path        string `yaml:"path"`
+	Subprotocol string `yaml:"subprotocol"`
+	BufferSize  int    `yaml:"buffer_size"`
+}
+
+func defaultTunnel() Tunnel {
+	return Tunnel{
+		Path:        transport.DefaultPath,
+		Subprotocol: transport.DefaultSubprotocol,
+		BufferSize:  transport.DefaultBufferSize,
+	}
+}
+
+func (t *Tunnel) validate(v *validator, path ...string) {
+	if !strings.HasPrefix(t.Path, "/") {
+		v.errorf(append(path, "path"), "path must start with /, got %q", t.Path)
+	}
+	if t.BufferSize <= 0 {
+		v.errorf(append(path, "buffer_size"), "buffer size must be positive")
+	}
+}
+
+// load decodes the file at path over out, which should already hold the
+// defaults, and returns the document so errors can be given line numbers.
+func load(path string, out interface{}) (*yaml.Node, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(raw, doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(out); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return doc, nil
+}
+
+func validateSocks(v *validator, ver int, password string, path ...string) {
+	if ver != 4 && ver != 5 {
+		v.errorf(append(path, "socks"), "SOCKS version must be 4 or 5")
+	}
+	if ver == 4 && password != "" {
+		v.errorf(append(path, "password"), "SOCKS4 can't send a password")
+	}
+}
+
+type validator struct {
+	doc  *yaml.Node
+	errs Errors
+}
+
+func (v *validator) errorf(path []string, format string, args ...interface{}) {
+	v.errs = append(v.errs, &Error{
+		Line: lineOf(v.doc, path),
+		Msg:  fmt.Sprintf("%s: %s", strings.Join(path, "."), fmt.Sprintf(format, args...)),
+	})
+}
+
+// err returns the errors ordered by line, so they are reported the same way
+// each time even when found by iterating over maps.
+func (v *validator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	sort.SliceStable(v.errs, func(i, j int) bool {
+		if v.errs[i].Line != v.errs[j].Line {
+			return v.errs[i].Line < v.errs[j].Line
+		}
+		return v.errs[i].Msg < v.errs[j].Msg
+	})
+	return v.errs
+}
+
+// lineOf finds the line a value was set on, falling back to the closest
+// parent which was set, or 0 without a document.
+func lineOf(doc *yaml.Node, path []string) int {
+	if doc == nil {
+		return 0
+	}
+	node := doc
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := node.Line
+	for _, key := range path {
+		var next *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == key {
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(node.Content) {
+				next = node.Content[i]
+			}
+		}
+		if next == nil {
+			return line
+		}
+		node = next
+		line = node.Line
+	}
+	return line
+}
@@ -0,0 +1,188 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestLoadServer(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		check   func(*Server) bool
+	}{
+		{"empty file keeps defaults", "", func(s *Server) bool {
+			return s.Listen == ":1443" && s.TLS.Cert == "cert.pem"
+		}},
+		{"comments only", "# nothing here\n", func(s *Server) bool {
+			return s.Listen == ":1443"
+		}},
+		{"overrides", "listen: :8443\ntimeouts:\n  idle: 1m\n", func(s *Server) bool {
+			return s.Listen == ":8443" &&
+				s.Timeouts.Idle == time.Minute &&
+				s.Timeouts.Handshake == DefaultServer().Timeouts.Handshake
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := LoadServer(writeFile(t, tt.content))
+			if err != nil {
+				t.Fatalf("LoadServer: %v", err)
+			}
+			if !tt.check(s) {
+				t.Errorf("unexpected config %+v", s)
+			}
+			if err := s.Validate(); err != nil {
+				t.Errorf("Validate: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"unknown field", "listen: :1443\nlisten_addr: :1\n"},
+		{"bad yaml", "listen: [\n"},
+		{"wrong type", "timeouts:\n  idle: soon\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadServer(writeFile(t, tt.content)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+	if _, err := LoadServer(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("missing file loaded")
+	}
+}
+
+func TestValidateLines(t *testing.T) {
+	content := `listen: ""
+timeouts:
+  linger: -1s
+  idle: -1s
+  dial: -1s
+auth:
+  keys:
+    "": a
+policy:
+  ports: http
+  users:
+    bob: [nope]
+    alice: [also-nope]
+`
+	want := []string{
+		"line 1: listen: listen address is required",
+		"line 3: timeouts.linger: timeout can't be negative",
+		"line 4: timeouts.idle: timeout can't be negative",
+		"line 5: timeouts.dial: timeout can't be negative",
+		"line 8: auth.keys: user names can't be empty, use key for a pre-shared key",
+		`line 10: policy.ports: invalid port "http"`,
+		"line 12: policy.users.bob: invalid CIDR nope/128: invalid CIDR address: nope/128",
+		"line 13: policy.users.alice: invalid CIDR also-nope/128: invalid CIDR address: also-nope/128",
+	}
+	path := writeFile(t, content)
+	// Errors found by iterating maps must come out in the same order every
+	// time.
+	for i := 0; i < 10; i++ {
+		s, err := LoadServer(path)
+		if err != nil {
+			t.Fatalf("LoadServer: %v", err)
+		}
+		err = s.Validate()
+		if err == nil {
+			t.Fatal("expected errors")
+		}
+		if got := strings.Split(err.Error(), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Fatalf("got errors:\n%s\nwant:\n%s", err, strings.Join(want, "\n"))
+		}
+	}
+}
+
+func TestValidateWithoutFile(t *testing.T) {
+	s := DefaultServer()
+	s.Timeouts.Dial = -1
+	s.Timeouts.Idle = -1
+	err := s.Validate()
+	errs, ok := err.(Errors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("got %v, want two errors", err)
+	}
+	for _, e := range errs {
+		if e.Line != 0 || strings.HasPrefix(e.Error(), "line") {
+			t.Errorf("error without a file has a line: %v", e)
+		}
+	}
+	if errs[0].Msg > errs[1].Msg {
+		t.Errorf("errors not sorted: %v", err)
+	}
+}
+
+func TestLoadClientTransportDefaults(t *testing.T) {
+	c, err := LoadClient(writeFile(t, `server:
+  address: example.com:443
+transports:
+  eu:
+    address: eu.example.com:443
+    path: /custom
+rules:
+  - tunnel:eu domain:example.eu
+  - tunnel:missing *
+`))
+	if err != nil {
+		t.Fatalf("LoadClient: %v", err)
+	}
+	eu := c.Transports["eu"]
+	def := defaultTunnel()
+	if eu.Path != "/custom" || eu.Subprotocol != def.Subprotocol || eu.BufferSize != def.BufferSize {
+		t.Errorf("named transport not filled in: %+v", eu.Tunnel)
+	}
+	err = c.Validate()
+	if err == nil || err.Error() != `line 9: rules.1: unknown transport "missing"` {
+		t.Errorf("got %v, want an unknown transport error on line 9", err)
+	}
+	rules, err := c.ParseRules()
+	if err != nil {
+		t.Fatalf("ParseRules: %v", err)
+	}
+	if rules[0].Line != 8 || rules[1].Line != 9 {
+		t.Errorf("rules on lines %d and %d, want 8 and 9", rules[0].Line, rules[1].Line)
+	}
+}
+
+func TestValidateAdmin(t *testing.T) {
+	tests := []struct {
+		addr, token string
+		ok          bool
+	}{
+		{"", "", true},
+		{"127.0.0.1:9090", "", true},
+		{"localhost:9090", "", true},
+		{":9090", "", false},
+		{"10.0.0.1:9090", "", false},
+		{":9090", "secret", true},
+	}
+	for _, tt := range tests {
+		s := DefaultServer()
+		s.Admin, s.AdminToken = tt.addr, tt.token
+		if err := s.Validate(); (err == nil) != tt.ok {
+			t.Errorf("admin %q with token %q: got %v", tt.addr, tt.token, err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package config
+
+import (
+	"strings"
+	"time"
+
+	"github.com/beefsack/go-under-cover/policy"
+	"gopkg.in/yaml.v3"
+)
+
+type Server struct {
+	Listen string `yaml:"listen"`
+	Log    Log    `yaml:"log"`
+	// ShutdownTimeout is how long to wait for tunnels to finish when
+	// stopping before closing them.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	Timeouts        Timeouts      `yaml:"timeouts"`
+	Audit           Audit         `yaml:"audit"`
+	// Admin is the address to serve /metrics and the session API on, if
+	// any.
+	Admin string `yaml:"admin"`
+	// AdminToken must be sent as a bearer token to use the admin API, and
+	// is required unless Admin is a loopback address.
+	AdminToken string     `yaml:"admin_token"`
+	TLS        TLS        `yaml:"tls"`
+	Tunnel     Tunnel     `yaml:"tunnel"`
+	Auth       ServerAuth `yaml:"auth"`
+	Policy     Policy     `yaml:"policy"`
+	Decoy      Decoy      `yaml:"decoy"`
+	Egress     Egress     `yaml:"egress"`
+
+	doc *yaml.Node
+}
+
+// TLS files are generated with a self-signed certificate if neither exists.
+type TLS struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+type ServerAuth struct {
+	// Key is a pre-shared key for clients which don't give a user.
+	Key      string            `yaml:"key"`
+	Keys     map[string]string `yaml:"keys"`
+	KeysFile string            `yaml:"keys_file"`
+}
+
+func (a *ServerAuth) Enabled() bool {
+	return a.Key != "" || len(a.Keys) > 0 || a.KeysFile != ""
+}
+
+type Policy struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+	Ports string   `yaml:"ports"`
+	// Users lists extra CIDRs each authenticated user may connect to.
+	Users map[string][]string `yaml:"users"`
+}
+
+type Decoy struct {
+	Dir          string `yaml:"dir"`
+	Upstream     string `yaml:"upstream"`
+	ServerHeader string `yaml:"server_header"`
+}
+
+// Egress is an upstream SOCKS proxy to send tunnels through, such as Tor or
+// a corporate gateway, rather than connecting directly.
+type Egress struct {
+	Address string `yaml:"address"`
+	// Socks is the version, 4 or 5.
+	Socks    int    `yaml:"socks"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	// RemoteDNS lets domains which can't be resolved locally, such as
+	// .onion addresses, through for the proxy to resolve. Only their port
+	// can be checked against the policy.
+	RemoteDNS bool `yaml:"remote_dns"`
+}
+
+func DefaultServer() *Server {
+	return &Server{
+		Listen:          ":1443",
+		Log:             defaultLog(),
+		ShutdownTimeout: DefaultShutdownTimeout,
+		Timeouts:        defaultTimeouts(),
+		TLS: TLS{
+			Cert: "cert.pem",
+			Key:  "key.pem",
+		},
+		Tunnel: defaultTunnel(),
+		Decoy: Decoy{
+			ServerHeader: "nginx",
+		},
+		Egress: Egress{
+			Socks: 5,
+		},
+	}
+}
+
+// LoadServer reads a server config file over the defaults.
+func LoadServer(path string) (*Server, error) {
+	s := DefaultServer()
+	doc, err := load(path, s)
+	if err != nil {
+		return nil, err
+	}
+	s.doc = doc
+	return s, nil
+}
+
+func (s *Server) Validate() error {
+	v := &validator{doc: s.doc}
+	if s.Listen == "" {
+		v.errorf([]string{"listen"}, "listen address is required")
+	}
+	s.Log.validate(v, "log")
+	validateShutdownTimeout(v, s.ShutdownTimeout)
+	validateAdmin(v, s.Admin, s.AdminToken)
+	s.Timeouts.validate(v, "timeouts")
+	s.Audit.validate(v, "audit")
+	if s.TLS.Cert == "" {
+		v.errorf([]string{"tls", "cert"}, "certificate file is required")
+	}
+	if s.TLS.Key == "" {
+		v.errorf([]string{"tls", "key"}, "key file is required")
+	}
+	s.Tunnel.validate(v, "tunnel")
+	for user := range s.Auth.Keys {
+		if user == "" {
+			v.errorf([]string{"auth", "keys"}, "user names can't be empty, use key for a pre-shared key")
+		}
+	}
+	if _, err := policy.ParseCIDRs(s.Policy.Allow...); err != nil {
+		v.errorf([]string{"policy", "allow"}, "%v", err)
+	}
+	if _, err := policy.ParseCIDRs(s.Policy.Deny...); err != nil {
+		v.errorf([]string{"policy", "deny"}, "%v", err)
+	}
+	if _, err := policy.ParsePorts(s.Policy.Ports); err != nil {
+		v.errorf([]string{"policy", "ports"}, "%v", err)
+	}
+	for user, cidrs := range s.Policy.Users {
+		if _, err := policy.ParseCIDRs(cidrs...); err != nil {
+			v.errorf([]string{"policy", "users", user}, "%v", err)
+		}
+	}
+	if s.Decoy.Dir != "" && s.Decoy.Upstream != "" {
+		v.errorf([]string{"decoy"}, "only one of dir and upstream may be set")
+	}
+	if s.Decoy.Upstream != "" && !strings.Contains(s.Decoy.Upstream, "://") {
+		v.errorf([]string{"decoy", "upstream"}, "upstream must be a URL")
+	}
+	if s.Egress.Address != "" {
+		validateSocks(v, s.Egress.Socks, s.Egress.Password, "egress")
+	}
+	return v.err()
+}
@@ -1 +1,398 @@
+// Package httpproxy is an HTTP proxy which sends CONNECT tunnels and
+// absolute-URI requests through a transport.
 package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beefsack/go-under-cover/bridge"
+	"github.com/beefsack/go-under-cover/llog"
+	"github.com/beefsack/go-under-cover/route"
+	"github.com/beefsack/go-under-cover/session"
+	"github.com/beefsack/go-under-cover/transport"
+)
+
+var logger = llog.Named("httpproxy")
+
+const DefaultRealm = "proxy"
+
+type Proxy struct {
+	Transport transport.Transport
+	// Credentials, when set, requires clients to send basic
+	// Proxy-Authorization.
+	Credentials func(username, password string) bool
+	Realm       string
+	// Bridge configures CONNECT tunnels, using the defaults if nil.
+	Bridge *bridge.Options
+
+	forward *httputil.ReverseProxy
+
+	transportsMu sync.Mutex
+	transports   map[string]*http.Transport
+
+	// The HTTP server doesn't track hijacked connections, so CONNECT
+	// tunnels are tracked here for Shutdown, which ends ctx if they don't
+	// finish in time.
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// userKey carries the authenticated user of a forwarded request in its
+// context, and sessionKey its session.
+type (
+	userKey    struct{}
+	sessionKey struct{}
+)
+
+func New(trans transport.Transport) *Proxy {
+	p := &Proxy{
+		Transport: trans,
+		Realm:     DefaultRealm,
+		conns:     map[net.Conn]bool{},
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.forward = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			// The outgoing request is already absolute, and we don't want
+			// to tell the destination who the client is.
+			r.Header["X-Forwarded-For"] = nil
+		},
+		Transport: roundTripper(p.roundTrip),
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.WithContext(r.Context()).Warn("failed to forward request to %s: %v", r.URL.Host, err)
+			if sess, ok := r.Context().Value(sessionKey{}).(*session.Session); ok {
+				sess.EndErr(err)
+			}
+			http.Error(w, http.StatusText(statusForError(err)), statusForError(err))
+		},
+	}
+	return p
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger.Debug("%s %s from %s", r.Method, r.RequestURI, r.RemoteAddr)
+	user, ok := p.authorize(r)
+	if !ok {
+		w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", p.Realm))
+		http.Error(
+			w,
+			http.StatusText(http.StatusProxyAuthRequired),
+			http.StatusProxyAuthRequired,
+		)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		p.connect(w, r, user)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "this is a proxy server", http.StatusBadRequest)
+		return
+	}
+	p.serveForward(w, r, user)
+}
+
+// serveForward forwards a request with an absolute URI as its own session,
+// which is closed by cancelling the request.
+func (p *Proxy) serveForward(w http.ResponseWriter, r *http.Request, user string) {
+	port := r.URL.Port()
+	if port == "" {
+		port = "80"
+		if r.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	address := net.JoinHostPort(r.URL.Hostname(), port)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	sess := session.Default.Start(session.Info{
+		Kind:        "http",
+		Source:      r.RemoteAddr,
+		Destination: address,
+		User:        user,
+		Transport:   route.Describe(p.Transport, hostOf(address), portOf(address)),
+	}, closerFunc(func() error {
+		cancel()
+		return nil
+	}))
+	defer sess.Done()
+	ctx = context.WithValue(ctx, userKey{}, user)
+	ctx = context.WithValue(ctx, sessionKey{}, sess)
+	ctx = llog.NewContext(ctx, connLogger(r, user, address))
+	r = r.WithContext(ctx)
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &countingBody{r.Body, sess}
+	}
+	p.forward.ServeHTTP(&countingResponseWriter{w, sess}, r)
+	sess.EndErr(nil)
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// roundTrip sends a forwarded request with a connection pool for its user,
+// so a connection dialed for one user is never reused by another.
+func (p *Proxy) roundTrip(r *http.Request) (*http.Response, error) {
+	user, _ := r.Context().Value(userKey{}).(string)
+	p.transportsMu.Lock()
+	if p.transports == nil {
+		p.transports = map[string]*http.Transport{}
+	}
+	t, ok := p.transports[user]
+	if !ok {
+		t = &http.Transport{
+			DialContext:           p.dialContext,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		}
+		p.transports[user] = t
+	}
+	p.transportsMu.Unlock()
+	return t.RoundTrip(r)
+}
+
+// authorize returns the user the client authenticated as, and whether it
+// may use the proxy.
+func (p *Proxy) authorize(r *http.Request) (string, bool) {
+	if p.Credentials == nil {
+		return "", true
+	}
+	auth := r.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if !strings.HasPrefix(auth, prefix) {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", false
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 || !p.Credentials(parts[0], parts[1]) {
+		return "", false
+	}
+	return parts[0], true
+}
+
+func (p *Proxy) connect(w http.ResponseWriter, r *http.Request, user string) {
+	address := r.Host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "443")
+	}
+	log := connLogger(r, user, address)
+	ctx := llog.NewContext(p.ctx, log)
+	dst, err := transport.DialContext(ctx, p.Transport, "tcp", address)
+	if err != nil {
+		log.Warn("failed to dial %s: %v", address, err)
+		http.Error(w, http.StatusText(statusForError(err)), statusForError(err))
+		return
+	}
+	defer dst.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		log.Warn("failed to hijack connection: %v", err)
+		return
+	}
+	defer conn.Close()
+	if !p.track(conn) {
+		return
+	}
+	defer p.untrack(conn)
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		log.Debug("failed to write CONNECT response: %v", err)
+		return
+	}
+	sess := session.Default.Start(session.Info{
+		Kind:        "http",
+		Source:      r.RemoteAddr,
+		Destination: address,
+		User:        user,
+		ResolvedIP:  route.ResolvedIP(dst),
+		Transport:   route.Describe(p.Transport, hostOf(address), portOf(address)),
+	}, conn, dst)
+	defer sess.Done()
+	result := bridge.Bridge(ctx, &bufferedConn{conn, buf.Reader}, sess.Wrap(dst), p.Bridge)
+	sess.End(result)
+	if err := result.Err(); err != nil {
+		log.Debug("failure during connection bridging: %v", err)
+	}
+}
+
+// Shutdown waits for CONNECT tunnels to finish, closing any left once ctx
+// is done, and closes idle connections kept for forwarded requests. The HTTP
+// server serving the proxy should be shut down as well, as it doesn't wait
+// for tunnels itself.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	defer p.closeIdleConnections()
+
+	idle := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		p.mu.Lock()
+		logger.Warn("closing %d CONNECT tunnels still active", len(p.conns))
+		for conn := range p.conns {
+			conn.Close()
+		}
+		p.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (p *Proxy) closeIdleConnections() {
+	p.transportsMu.Lock()
+	defer p.transportsMu.Unlock()
+	for _, t := range p.transports {
+		t.CloseIdleConnections()
+	}
+}
+
+func (p *Proxy) track(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	p.conns[conn] = true
+	p.wg.Add(1)
+	return true
+}
+
+func (p *Proxy) untrack(conn net.Conn) {
+	p.mu.Lock()
+	delete(p.conns, conn)
+	p.mu.Unlock()
+	p.wg.Done()
+}
+
+func (p *Proxy) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d, err := transport.NewDialer(p.Transport)
+	if err != nil {
+		return nil, err
+	}
+	return d.DialContext(ctx, network, address)
+}
+
+// connLogger logs with the fields of the connection a request is for.
+func connLogger(r *http.Request, user, address string) *llog.Logger {
+	return logger.With(
+		llog.F("remote", r.RemoteAddr),
+		llog.F("user", user),
+		llog.F("dest", address),
+	)
+}
+
+func hostOf(address string) string {
+	host, _, _ := net.SplitHostPort(address)
+	return host
+}
+
+func portOf(address string) uint16 {
+	_, portStr, _ := net.SplitHostPort(address)
+	port, _ := strconv.ParseUint(portStr, 10, 16)
+	return uint16(port)
+}
+
+func statusForError(err error) int {
+	var dialErr *transport.DialError
+	if !errors.As(err, &dialErr) {
+		return http.StatusBadGateway
+	}
+	switch dialErr.Code {
+	case transport.StatusDenied:
+		return http.StatusForbidden
+	case transport.StatusTimeout:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// bufferedConn reads anything the client sent after its CONNECT request
+// which the HTTP server has already buffered.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return bridge.CloseWrite(c.Conn)
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// countingBody counts a forwarded request body as sent up.
+type countingBody struct {
+	io.ReadCloser
+	s *session.Session
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.s.Up(n)
+	return n, err
+}
+
+// countingResponseWriter counts a forwarded response body as received.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	s *session.Session
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.s.Down(n)
+	return n, err
+}
+
+func (w *countingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,167 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beefsack/go-under-cover/transport"
+)
+
+// pipeTransport dials by handing out one end of a pipe, keeping the other.
+type pipeTransport struct {
+	peers chan net.Conn
+}
+
+func (p *pipeTransport) Dial(network, address string) (io.ReadWriteCloser, error) {
+	a, b := net.Pipe()
+	p.peers <- b
+	return a, nil
+}
+
+func (p *pipeTransport) Listen() (transport.Listener, error) {
+	return nil, io.EOF
+}
+
+// tcpTransport dials destinations directly.
+type tcpTransport struct{}
+
+func (tcpTransport) Dial(network, address string) (io.ReadWriteCloser, error) {
+	return net.Dial(network, address)
+}
+
+func (tcpTransport) Listen() (transport.Listener, error) {
+	return nil, io.EOF
+}
+
+func (tcpTransport) SupportsDeadlines() bool {
+	return true
+}
+
+func connect(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	io.WriteString(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("failed to read CONNECT response: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT returned %s", res.Status)
+	}
+	return conn
+}
+
+func TestShutdown(t *testing.T) {
+	tests := []struct {
+		name string
+		// finish ends the tunnel before the deadline if set.
+		finish  bool
+		wantErr error
+	}{
+		{"waits for tunnels", true, nil},
+		{"closes tunnels at deadline", false, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trans := &pipeTransport{peers: make(chan net.Conn, 1)}
+			p := New(trans)
+			srv := httptest.NewServer(p)
+			defer srv.Close()
+
+			conn := connect(t, strings.TrimPrefix(srv.URL, "http://"))
+			defer conn.Close()
+			peer := <-trans.peers
+			defer peer.Close()
+			go io.Copy(ioutil.Discard, peer)
+
+			if tt.finish {
+				go func() {
+					time.Sleep(50 * time.Millisecond)
+					conn.Close()
+					peer.Close()
+				}()
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if err := p.Shutdown(ctx); err != tt.wantErr {
+				t.Fatalf("Shutdown returned %v, want %v", err, tt.wantErr)
+			}
+			if tt.finish {
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+				t.Errorf("tunnel still open after Shutdown: %v", err)
+			}
+		})
+	}
+}
+
+func TestShutdownRefusesNewTunnels(t *testing.T) {
+	trans := &pipeTransport{peers: make(chan net.Conn, 1)}
+	p := New(trans)
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	(<-trans.peers).Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := http.ReadResponse(bufio.NewReader(conn), nil); err == nil {
+		t.Error("got a response from a proxy which was shut down")
+	}
+}
+
+func TestShutdownClosesIdleForwardConnections(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	web := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	web.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	web.Start()
+	defer web.Close()
+	p := New(tcpTransport{})
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	proxy, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxy)}}
+	res, err := client.Get(web.URL)
+	if err != nil {
+		t.Fatalf("GET through proxy: %v", err)
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	client.CloseIdleConnections()
+
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("idle connection to the destination still open after Shutdown")
+	}
+}
@@ -1,9 +1,13 @@
 package llog
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -22,24 +26,145 @@ var levelStrs = map[int]string{
 	LevelTrace: "[TRACE]",
 }
 
+var levelNames = map[int]string{
+	LevelError: "error",
+	LevelWarn:  "warn",
+	LevelInfo:  "info",
+	LevelDebug: "debug",
+	LevelTrace: "trace",
+}
+
 var Default = New(LevelError, log.New(os.Stderr, "", log.LstdFlags))
 
+// Field is a key and value attached to log entries.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field {
+	return Field{key, value}
+}
+
+// Entry is a single log line on its way to a Sink.
+type Entry struct {
+	Time  time.Time
+	Level int
+	// Logger is the name of the component which logged the entry, if any.
+	Logger  string
+	Message string
+	Fields  []Field
+}
+
+// Logger writes entries at or below its level to a sink. Loggers created
+// with With or Named share their parent's sink, and their parent's level
+// unless SetLevel is called.
 type Logger struct {
-	Level  int
-	logger *log.Logger
+	// level is the most verbose level to log, or zero to use the parent's.
+	// It is accessed atomically so it can be changed while logging.
+	level int32
+
+	name   string
+	fields []Field
+	parent *Logger
+
+	mu   sync.RWMutex
+	sink Sink
 }
 
 func New(level int, logger *log.Logger) *Logger {
 	return &Logger{
-		Level:  level,
-		logger: logger,
+		level: int32(level),
+		sink:  NewLogSink(logger),
+	}
+}
+
+// SetLevel sets the most verbose level to log, or zero to use the parent's.
+func (l *Logger) SetLevel(level int) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+// Level returns the most verbose level logged, which may be the parent's.
+func (l *Logger) Level() int {
+	for ; l != nil; l = l.parent {
+		if level := atomic.LoadInt32(&l.level); level != 0 {
+			return int(level)
+		}
+	}
+	return LevelError
+}
+
+// SetSink sends entries from this logger and its children to s.
+func (l *Logger) SetSink(s Sink) {
+	l.mu.Lock()
+	l.sink = s
+	l.mu.Unlock()
+}
+
+// With returns a child logger which adds fields to every entry.
+func (l *Logger) With(fields ...Field) *Logger {
+	return &Logger{
+		name:   l.name,
+		fields: append(append([]Field{}, l.fields...), fields...),
+		parent: l,
 	}
 }
 
+type contextKey struct{}
+
+// NewContext returns a context carrying l, so loggers further down can add
+// its fields with WithContext.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or nil.
+func FromContext(ctx context.Context) *Logger {
+	l, _ := ctx.Value(contextKey{}).(*Logger)
+	return l
+}
+
+// WithContext returns a child of l with the fields of the logger carried by
+// ctx, such as the connection being handled, keeping l's name and level.
+func (l *Logger) WithContext(ctx context.Context) *Logger {
+	if c := FromContext(ctx); c != nil && len(c.fields) > 0 {
+		return l.With(c.fields...)
+	}
+	return l
+}
+
+// Enabled reports whether entries at level would be logged.
+func (l *Logger) Enabled(level int) bool {
+	return l.Level() >= level
+}
+
+func (l *Logger) getSink() Sink {
+	for ; l != nil; l = l.parent {
+		l.mu.RLock()
+		s := l.sink
+		l.mu.RUnlock()
+		if s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
 func (l *Logger) Print(level int, format string, v ...interface{}) {
-	if l.Level >= level {
-		l.logger.Printf("%s %s", levelStrs[level], fmt.Sprintf(format, v...))
+	if !l.Enabled(level) {
+		return
+	}
+	s := l.getSink()
+	if s == nil {
+		return
 	}
+	s.Write(&Entry{
+		Time:    time.Now(),
+		Level:   level,
+		Logger:  l.name,
+		Message: fmt.Sprintf(format, v...),
+		Fields:  l.fields,
+	})
 }
 
 func (l *Logger) Fatal(format string, v ...interface{}) {
@@ -67,6 +192,34 @@ func (l *Logger) Trace(format string, v ...interface{}) {
 	l.Print(LevelTrace, format, v...)
 }
 
+var (
+	namedMu sync.Mutex
+	named   = map[string]*Logger{}
+)
+
+// Named returns the logger for a component, which is a child of Default
+// with its own level. The same logger is returned for the same name.
+func Named(name string) *Logger {
+	namedMu.Lock()
+	defer namedMu.Unlock()
+	l, ok := named[name]
+	if !ok {
+		l = &Logger{
+			name:   name,
+			parent: Default,
+		}
+		named[name] = l
+	}
+	return l
+}
+
+// SetLevels sets the level of named loggers.
+func SetLevels(levels map[string]int) {
+	for name, level := range levels {
+		Named(name).SetLevel(level)
+	}
+}
+
 func Print(level int, format string, v ...interface{}) {
 	Default.Print(level, format, v...)
 }
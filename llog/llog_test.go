@@ -0,0 +1,92 @@
+package llog
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+type captureSink struct {
+	mu      sync.Mutex
+	entries []*Entry
+}
+
+func (s *captureSink) Write(e *Entry) {
+	s.mu.Lock()
+	s.entries = append(s.entries, e)
+	s.mu.Unlock()
+}
+
+func newTestLogger(level int) (*Logger, *captureSink) {
+	sink := &captureSink{}
+	l := &Logger{}
+	l.SetLevel(level)
+	l.SetSink(sink)
+	return l, sink
+}
+
+func TestLevel(t *testing.T) {
+	tests := []struct {
+		name        string
+		parent      int
+		child       int
+		wantEnabled map[int]bool
+	}{
+		{"inherits parent", LevelInfo, 0, map[int]bool{LevelInfo: true, LevelDebug: false}},
+		{"more verbose child", LevelInfo, LevelTrace, map[int]bool{LevelTrace: true}},
+		{"quieter child", LevelDebug, LevelError, map[int]bool{LevelError: true, LevelWarn: false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent, _ := newTestLogger(tt.parent)
+			child := parent.With(F("k", "v"))
+			child.SetLevel(tt.child)
+			for level, want := range tt.wantEnabled {
+				if got := child.Enabled(level); got != want {
+					t.Errorf("Enabled(%d) = %v, want %v", level, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestSetLevelsWhileLogging is for the race detector.
+func TestSetLevelsWhileLogging(t *testing.T) {
+	l := Named("llog-test")
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			l.Trace("message %d", i)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			SetLevels(map[string]int{"llog-test": LevelError + i%2})
+		}
+	}()
+	wg.Wait()
+}
+
+func TestWithContext(t *testing.T) {
+	conn, _ := newTestLogger(LevelError)
+	conn = conn.With(F("conn", 1), F("user", "alice"))
+	component, sink := newTestLogger(LevelDebug)
+	component.name = "bridge"
+
+	component.WithContext(context.Background()).Debug("without")
+	component.WithContext(NewContext(context.Background(), conn)).Debug("with")
+
+	if len(sink.entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(sink.entries))
+	}
+	if fields := sink.entries[0].Fields; len(fields) != 0 {
+		t.Errorf("got fields %v without a logger in the context", fields)
+	}
+	e := sink.entries[1]
+	if e.Logger != "bridge" || len(e.Fields) != 2 || e.Fields[1] != F("user", "alice") {
+		t.Errorf("got entry from %q with fields %v", e.Logger, e.Fields)
+	}
+}
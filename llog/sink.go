@@ -0,0 +1,143 @@
+package llog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Sink receives every entry a logger lets through.
+type Sink interface {
+	Write(e *Entry)
+}
+
+// Encoder formats an entry as a single line, including the newline.
+type Encoder func(e *Entry) []byte
+
+// NewLogSink writes text entries through a standard logger, which adds its
+// own timestamp.
+func NewLogSink(logger *log.Logger) Sink {
+	return &logSink{logger}
+}
+
+type logSink struct {
+	logger *log.Logger
+}
+
+func (s *logSink) Write(e *Entry) {
+	s.logger.Print(formatText(e))
+}
+
+// NewWriterSink encodes entries to w.
+func NewWriterSink(w io.Writer, enc Encoder) Sink {
+	return &writerSink{w: w, enc: enc}
+}
+
+func NewTextSink(w io.Writer) Sink {
+	return NewWriterSink(w, TextEncoder)
+}
+
+func NewJSONSink(w io.Writer) Sink {
+	return NewWriterSink(w, JSONEncoder)
+}
+
+type writerSink struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc Encoder
+}
+
+func (s *writerSink) Write(e *Entry) {
+	line := s.enc(e)
+	s.mu.Lock()
+	s.w.Write(line)
+	s.mu.Unlock()
+}
+
+// TextEncoder writes entries the way llog always has, with fields appended
+// as key=value.
+func TextEncoder(e *Entry) []byte {
+	return []byte(e.Time.Format("2006/01/02 15:04:05 ") + formatText(e) + "\n")
+}
+
+func formatText(e *Entry) string {
+	var b bytes.Buffer
+	b.WriteString(levelStrs[e.Level])
+	b.WriteByte(' ')
+	if e.Logger != "" {
+		b.WriteString(e.Logger)
+		b.WriteString(": ")
+	}
+	b.WriteString(e.Message)
+	for _, f := range e.Fields {
+		b.WriteByte(' ')
+		b.WriteString(f.Key)
+		b.WriteByte('=')
+		b.WriteString(formatValue(f.Value))
+	}
+	return b.String()
+}
+
+func formatValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || bytes.ContainsAny([]byte(s), " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// JSONEncoder writes each entry as a JSON object with time, level, logger
+// and msg keys alongside the fields.
+func JSONEncoder(e *Entry) []byte {
+	var b bytes.Buffer
+	b.WriteString(`{"time":`)
+	writeJSON(&b, e.Time.Format(time.RFC3339Nano))
+	b.WriteString(`,"level":`)
+	writeJSON(&b, levelNames[e.Level])
+	if e.Logger != "" {
+		b.WriteString(`,"logger":`)
+		writeJSON(&b, e.Logger)
+	}
+	b.WriteString(`,"msg":`)
+	writeJSON(&b, e.Message)
+	for _, f := range e.Fields {
+		b.WriteByte(',')
+		writeJSON(&b, f.Key)
+		b.WriteByte(':')
+		writeJSON(&b, jsonValue(f.Value))
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+// jsonValue keeps values JSON can represent and turns anything else, such
+// as errors and addresses, into its string form.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, bool, string, int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(v)
+}
+
+func writeJSON(b *bytes.Buffer, v interface{}) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		raw, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(raw)
+}
@@ -0,0 +1,51 @@
+package llog
+
+import (
+	"context"
+	"log/slog"
+)
+
+// LevelSlogTrace is the slog level trace entries are sent at.
+const LevelSlogTrace = slog.LevelDebug - 4
+
+// NewSlogSink sends entries to a slog handler, so llog output can join an
+// application's own logs. The logger name is added as a "logger"
+// attribute.
+func NewSlogSink(h slog.Handler) Sink {
+	return &slogSink{h}
+}
+
+type slogSink struct {
+	h slog.Handler
+}
+
+func (s *slogSink) Write(e *Entry) {
+	level := SlogLevel(e.Level)
+	ctx := context.Background()
+	if !s.h.Enabled(ctx, level) {
+		return
+	}
+	r := slog.NewRecord(e.Time, level, e.Message, 0)
+	if e.Logger != "" {
+		r.AddAttrs(slog.String("logger", e.Logger))
+	}
+	for _, f := range e.Fields {
+		r.AddAttrs(slog.Any(f.Key, f.Value))
+	}
+	s.h.Handle(ctx, r)
+}
+
+// SlogLevel converts an llog level to the closest slog level.
+func SlogLevel(level int) slog.Level {
+	switch level {
+	case LevelError:
+		return slog.LevelError
+	case LevelWarn:
+		return slog.LevelWarn
+	case LevelInfo:
+		return slog.LevelInfo
+	case LevelDebug:
+		return slog.LevelDebug
+	}
+	return LevelSlogTrace
+}
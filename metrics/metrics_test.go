@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounter("test_requests_total", "Requests served,\nby path \\ method.", "path", "method")
+	active := r.NewGauge("test_active", "Active things.")
+	latency := r.NewHistogram("test_seconds", "Latency.", []float64{0.1, 1}, "route")
+	r.NewCounter("test_unused_total", "Never incremented.")
+
+	requests.Inc("/a", "GET")
+	requests.Add(2, "/a", "GET")
+	requests.Inc(`/"quoted"\path`+"\n", "POST")
+	active.Inc()
+	active.Inc()
+	active.Dec()
+	latency.Observe(0.05, "direct")
+	latency.Observe(0.5, "direct")
+	latency.Observe(5, "direct")
+
+	want := `# HELP test_requests_total Requests served,\nby path \\ method.
+# TYPE test_requests_total counter
+test_requests_total{path="/\"quoted\"\\path\n",method="POST"} 1
+test_requests_total{path="/a",method="GET"} 3
+# HELP test_active Active things.
+# TYPE test_active gauge
+test_active 1
+# HELP test_seconds Latency.
+# TYPE test_seconds histogram
+test_seconds_bucket{route="direct",le="0.1"} 1
+test_seconds_bucket{route="direct",le="1"} 2
+test_seconds_bucket{route="direct",le="+Inf"} 3
+test_seconds_sum{route="direct"} 5.55
+test_seconds_count{route="direct"} 3
+# HELP test_unused_total Never incremented.
+# TYPE test_unused_total counter
+`
+	buf := &bytes.Buffer{}
+	if err := r.Write(buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf, want)
+	}
+}
+
+func TestWrongLabelCount(t *testing.T) {
+	c := NewRegistry().NewCounter("test_total", "Test.", "label")
+	defer func() {
+		if recover() == nil {
+			t.Error("Inc with the wrong number of labels didn't panic")
+		}
+	}()
+	c.Inc()
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.NewGauge("test_active", "Active things.").Set(2)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("got Content-Type %q", ct)
+	}
+	if !strings.Contains(w.Body.String(), "\ntest_active 2\n") {
+		t.Errorf("got body %q", w.Body.String())
+	}
+}
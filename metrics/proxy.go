@@ -0,0 +1,103 @@
+package metrics
+
+import "strconv"
+
+var (
+	ActiveConnections = Default.NewGauge(
+		"undercover_active_connections",
+		"Connections currently being proxied.",
+		"kind",
+	)
+	ActiveSessions = Default.NewGauge(
+		"undercover_active_sessions",
+		"WebSocket tunnel sessions currently open.",
+	)
+	HandshakeSeconds = Default.NewHistogram(
+		"undercover_handshake_seconds",
+		"Time taken to complete SOCKS and WebSocket handshakes.",
+		DefaultBuckets,
+		"protocol",
+	)
+	DialSeconds = Default.NewHistogram(
+		"undercover_dial_seconds",
+		"Time taken to connect to destinations.",
+		DefaultBuckets,
+		"route",
+	)
+	DialErrorsTotal = Default.NewCounter(
+		"undercover_dial_errors_total",
+		"Failed dials by the status sent back to the client.",
+		"status",
+	)
+	SocksErrorsTotal = Default.NewCounter(
+		"undercover_socks_errors_total",
+		"SOCKS requests which failed, by reply code.",
+		"reply",
+	)
+	BytesTotal = Default.NewCounter(
+		"undercover_bytes_total",
+		"Bytes proxied, up from clients or down to them.",
+		"direction",
+	)
+	UserConnectionsTotal = Default.NewCounter(
+		"undercover_user_connections_total",
+		"Connections proxied for each authenticated user.",
+		"user",
+	)
+	UserBytesTotal = Default.NewCounter(
+		"undercover_user_bytes_total",
+		"Bytes proxied for each authenticated user.",
+		"user",
+		"direction",
+	)
+	PortConnectionsTotal = Default.NewCounter(
+		"undercover_port_connections_total",
+		"Connections proxied to each destination port.",
+		"port",
+	)
+	PortBytesTotal = Default.NewCounter(
+		"undercover_port_bytes_total",
+		"Bytes proxied to each destination port.",
+		"port",
+		"direction",
+	)
+)
+
+// Tracker accounts for a single proxied connection, which counts as active
+// from Track until Done.
+type Tracker struct {
+	kind, user, port string
+}
+
+func Track(kind, user string, port uint16) *Tracker {
+	t := &Tracker{
+		kind: kind,
+		user: user,
+		port: strconv.Itoa(int(port)),
+	}
+	ActiveConnections.Inc(kind)
+	UserConnectionsTotal.Inc(user)
+	PortConnectionsTotal.Inc(t.port)
+	return t
+}
+
+func (t *Tracker) Up(n int) {
+	t.add("up", n)
+}
+
+func (t *Tracker) Down(n int) {
+	t.add("down", n)
+}
+
+func (t *Tracker) add(direction string, n int) {
+	if n <= 0 {
+		return
+	}
+	BytesTotal.Add(float64(n), direction)
+	UserBytesTotal.Add(float64(n), t.user, direction)
+	PortBytesTotal.Add(float64(n), t.port, direction)
+}
+
+func (t *Tracker) Done() {
+	ActiveConnections.Dec(t.kind)
+}
@@ -0,0 +1,209 @@
+// Package policy restricts which destinations the server connects to, so it
+// can't be used to reach its own network.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var ErrDenied = errors.New("denied by policy")
+
+// DefaultDeny covers loopback, link-local, private, shared and other
+// special purpose ranges, which include cloud metadata services.
+var DefaultDeny = MustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+type PortRange struct {
+	From, To uint16
+}
+
+func (pr PortRange) Contains(port uint16) bool {
+	return port >= pr.From && port <= pr.To
+}
+
+type Policy struct {
+	// Allow takes precedence over Deny.
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+	// Ports restricts destinations to these ports, or allows any port if
+	// empty.
+	Ports []PortRange
+	// Users replaces the policy for authenticated users.
+	Users map[string]*Policy
+}
+
+// New returns a policy denying the default ranges.
+func New() *Policy {
+	return &Policy{
+		Deny:  append([]*net.IPNet{}, DefaultDeny...),
+		Users: map[string]*Policy{},
+	}
+}
+
+// ForUser returns the policy which applies to user.
+func (p *Policy) ForUser(user string) *Policy {
+	if up, ok := p.Users[user]; ok {
+		return up
+	}
+	return p
+}
+
+// Check returns an error wrapping ErrDenied if user may not connect to the
+// IP and port.
+func (p *Policy) Check(user string, ip net.IP, port uint16) error {
+	if err := p.CheckPort(user, port); err != nil {
+		return err
+	}
+	p = p.ForUser(user)
+	if containsIP(p.Allow, ip) {
+		return nil
+	}
+	if containsIP(p.Deny, ip) {
+		return fmt.Errorf("%w: %s", ErrDenied, ip)
+	}
+	return nil
+}
+
+// CheckPort checks only the port restrictions, for destinations whose IP
+// isn't known, such as domains resolved by an egress proxy.
+func (p *Policy) CheckPort(user string, port uint16) error {
+	p = p.ForUser(user)
+	if len(p.Ports) > 0 && !containsPort(p.Ports, port) {
+		return fmt.Errorf("%w: port %d", ErrDenied, port)
+	}
+	return nil
+}
+
+// CheckAddr is Check for a resolved IP:port address.
+func (p *Policy) CheckAddr(user, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: %s is not resolved", ErrDenied, host)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %s", portStr)
+	}
+	return p.Check(user, ip, uint16(port))
+}
+
+// Dialer returns a copy of base which checks the policy for user against
+// the address actually being connected to, after DNS resolution, so a
+// domain can't be rebound to a denied address.
+func (p *Policy) Dialer(user string, base *net.Dialer) *net.Dialer {
+	d := *base
+	control := base.Control
+	d.Control = func(network, address string, c syscall.RawConn) error {
+		if err := p.CheckAddr(user, address); err != nil {
+			return err
+		}
+		if control != nil {
+			return control(network, address, c)
+		}
+		return nil
+	}
+	return &d
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPort(ranges []PortRange, port uint16) bool {
+	for _, pr := range ranges {
+		if pr.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCIDRs parses a list of CIDRs, treating bare IPs as single hosts.
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			if ip := net.ParseIP(c); ip != nil && ip.To4() != nil {
+				c += "/32"
+			} else {
+				c += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %s: %v", c, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func MustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets, err := ParseCIDRs(cidrs...)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+// ParsePorts parses a comma separated list of ports and ranges such as
+// 80,443,8000-8999.
+func ParsePorts(s string) ([]PortRange, error) {
+	ranges := []PortRange{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		from, err := strconv.ParseUint(bounds[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", bounds[0])
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, err = strconv.ParseUint(bounds[1], 10, 16); err != nil {
+				return nil, fmt.Errorf("invalid port %q", bounds[1])
+			}
+		}
+		if to < from {
+			return nil, fmt.Errorf("invalid port range %q", part)
+		}
+		ranges = append(ranges, PortRange{uint16(from), uint16(to)})
+	}
+	return ranges, nil
+}
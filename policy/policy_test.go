@@ -0,0 +1,180 @@
+package policy
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	p := New()
+	p.Allow = MustParseCIDRs("10.1.0.0/16")
+	p.Ports = []PortRange{{80, 80}, {443, 443}}
+	p.Users["admin"] = &Policy{
+		Allow: MustParseCIDRs("192.168.0.0/16"),
+		Deny:  DefaultDeny,
+	}
+	tests := []struct {
+		name    string
+		user    string
+		ip      string
+		port    uint16
+		allowed bool
+	}{
+		{"public", "", "93.184.216.34", 443, true},
+		{"loopback", "", "127.0.0.1", 80, false},
+		{"private", "", "192.168.1.1", 80, false},
+		{"metadata", "", "169.254.169.254", 80, false},
+		{"ipv6 loopback", "", "::1", 80, false},
+		{"ipv6 unique local", "", "fd00::1", 443, false},
+		{"ipv4-mapped loopback", "", "::ffff:127.0.0.1", 80, false},
+		{"allow overrides deny", "", "10.1.2.3", 80, true},
+		{"outside allow", "", "10.2.0.1", 80, false},
+		{"port not allowed", "", "93.184.216.34", 22, false},
+		{"user policy", "admin", "192.168.1.1", 22, true},
+		{"user policy still denies", "admin", "10.1.2.3", 80, false},
+		{"unknown user gets default", "nobody", "192.168.1.1", 80, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.Check(tt.user, net.ParseIP(tt.ip), tt.port)
+			if allowed := err == nil; allowed != tt.allowed {
+				t.Fatalf("got %v, want allowed %v", err, tt.allowed)
+			}
+			if err != nil && !errors.Is(err, ErrDenied) {
+				t.Errorf("error %v doesn't wrap ErrDenied", err)
+			}
+		})
+	}
+}
+
+func TestCheckAddr(t *testing.T) {
+	p := New()
+	tests := []struct {
+		address string
+		denied  bool
+		invalid bool
+	}{
+		{"93.184.216.34:443", false, false},
+		{"[2606:2800:220:1::]:80", false, false},
+		{"127.0.0.1:80", true, false},
+		{"localhost:80", true, false},
+		{"93.184.216.34", false, true},
+		{"93.184.216.34:99999", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			err := p.CheckAddr("", tt.address)
+			switch {
+			case tt.denied && !errors.Is(err, ErrDenied):
+				t.Errorf("got %v, want denied", err)
+			case tt.invalid && (err == nil || errors.Is(err, ErrDenied)):
+				t.Errorf("got %v, want an invalid address error", err)
+			case !tt.denied && !tt.invalid && err != nil:
+				t.Errorf("got %v, want allowed", err)
+			}
+		})
+	}
+}
+
+func TestCheckPort(t *testing.T) {
+	p := New()
+	p.Ports = []PortRange{{8000, 8999}}
+	p.Users["dev"] = &Policy{}
+	tests := []struct {
+		user    string
+		port    uint16
+		allowed bool
+	}{
+		{"", 8080, true},
+		{"", 80, false},
+		{"dev", 22, true},
+	}
+	for _, tt := range tests {
+		if err := p.CheckPort(tt.user, tt.port); (err == nil) != tt.allowed {
+			t.Errorf("%q port %d: got %v, want allowed %v", tt.user, tt.port, err, tt.allowed)
+		}
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		input   []string
+		want    []string
+		wantErr bool
+	}{
+		{[]string{"10.0.0.0/8", " 192.0.2.1 ", "::1", ""}, []string{"10.0.0.0/8", "192.0.2.1/32", "::1/128"}, false},
+		{[]string{"not-a-cidr"}, nil, true},
+		{[]string{"10.0.0.0/40"}, nil, true},
+	}
+	for _, tt := range tests {
+		nets, err := ParseCIDRs(tt.input...)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: got error %v, want error %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if len(nets) != len(tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.input, nets, tt.want)
+			continue
+		}
+		for i, n := range nets {
+			if n.String() != tt.want[i] {
+				t.Errorf("%v: got %s, want %s", tt.input, n, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []PortRange
+		wantErr bool
+	}{
+		{"", []PortRange{}, false},
+		{"80", []PortRange{{80, 80}}, false},
+		{"80, 443,8000-8999", []PortRange{{80, 80}, {443, 443}, {8000, 8999}}, false},
+		{"0-65535", []PortRange{{0, 65535}}, false},
+		{"http", nil, true},
+		{"65536", nil, true},
+		{"90-80", nil, true},
+		{"80-", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParsePorts(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDialerChecksResolvedAddress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	p := New()
+	// localhost only resolves to a denied address once it is dialed.
+	if _, err := p.Dialer("", &net.Dialer{}).Dial("tcp", net.JoinHostPort("localhost", port)); !errors.Is(err, ErrDenied) {
+		t.Errorf("dial to localhost returned %v, want denied", err)
+	}
+	p.Allow = MustParseCIDRs("127.0.0.1")
+	conn, err := p.Dialer("", &net.Dialer{}).Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("allowed dial failed: %v", err)
+	}
+	conn.Close()
+}
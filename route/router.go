@@ -0,0 +1,229 @@
+// Package route decides per destination whether to connect directly,
+// through a named transport, or not at all.
+package route
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/beefsack/go-under-cover/bridge"
+	"github.com/beefsack/go-under-cover/llog"
+	"github.com/beefsack/go-under-cover/metrics"
+	"github.com/beefsack/go-under-cover/transport"
+)
+
+var logger = llog.Named("route")
+
+// DefaultTransport is the name of the transport used by tunnel rules
+// without a name, and when no rule matches.
+const DefaultTransport = ""
+
+// Router is a transport.Transport which dials each destination according to
+// the first rule matching it. Only TCP connections can be sent directly, so
+// other networks are tunneled through the default transport instead unless
+// blocked.
+type Router struct {
+	Transports map[string]transport.Transport
+	Dialer     *net.Dialer
+
+	mu    sync.RWMutex
+	rules []*Rule
+	path  string
+}
+
+func NewRouter(transports map[string]transport.Transport) *Router {
+	return &Router{
+		Transports: transports,
+		Dialer:     &net.Dialer{},
+	}
+}
+
+// SetRules replaces the rules after checking they only name known
+// transports.
+func (r *Router) SetRules(rules []*Rule) error {
+	for _, rule := range rules {
+		if rule.Action.Kind != ActionTunnel {
+			continue
+		}
+		if _, ok := r.Transports[rule.Action.Transport]; !ok {
+			return fmt.Errorf(
+				"line %d: unknown transport %q",
+				rule.Line,
+				rule.Action.Transport,
+			)
+		}
+	}
+	r.mu.Lock()
+	r.rules = rules
+	r.mu.Unlock()
+	return nil
+}
+
+// Load reads rules from a file, which Reload will read again.
+func (r *Router) Load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+	rules, err := Parse(file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if err := r.SetRules(rules); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	r.mu.Lock()
+	r.path = path
+	r.mu.Unlock()
+	logger.Info("loaded %d rules from %s", len(rules), path)
+	return nil
+}
+
+// Reload reads the rules file again, keeping the current rules if it is
+// invalid.
+func (r *Router) Reload() error {
+	r.mu.RLock()
+	path := r.path
+	r.mu.RUnlock()
+	if path == "" {
+		return errors.New("no rules file loaded")
+	}
+	return r.Load(path)
+}
+
+// Route returns the action for a destination.
+func (r *Router) Route(host string, port uint16) Action {
+	return r.route(logger, host, port)
+}
+
+func (r *Router) route(log *llog.Logger, host string, port uint16) Action {
+	ip := net.ParseIP(host)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, rule := range r.rules {
+		if rule.Matches(host, ip, port) {
+			log.Trace(
+				"%s:%d matched rule on line %d: %s %s",
+				host,
+				port,
+				rule.Line,
+				rule.Action,
+				rule.Match,
+			)
+			return rule.Action
+		}
+	}
+	return Action{Kind: ActionTunnel, Transport: DefaultTransport}
+}
+
+// Describe says how trans sends traffic for a destination, which is by
+// its route if trans is a Router.
+func Describe(trans transport.Transport, host string, port uint16) string {
+	switch t := trans.(type) {
+	case *Router:
+		return t.Route(host, port).String()
+	case *transport.SOCKS:
+		return "socks"
+	}
+	return "tunnel"
+}
+
+func (r *Router) Dial(network, address string) (io.ReadWriteCloser, error) {
+	return r.DialContext(context.Background(), network, address)
+}
+
+func (r *Router) DialContext(ctx context.Context, network, address string) (io.ReadWriteCloser, error) {
+	log := logger.WithContext(ctx)
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to split address: %v", err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", portStr)
+	}
+	action := r.route(log, host, uint16(port))
+	log.Debug("routing %s %s via %s", network, address, action)
+
+	switch action.Kind {
+	case ActionBlock:
+		return nil, &transport.DialError{Code: transport.StatusDenied}
+	case ActionDirect:
+		if network == "tcp" {
+			return r.dialDirect(ctx, address)
+		}
+		action.Transport = DefaultTransport
+	}
+	trans, ok := r.Transports[action.Transport]
+	if !ok {
+		return nil, fmt.Errorf("unknown transport %q", action.Transport)
+	}
+	start := time.Now()
+	conn, err := transport.DialContext(ctx, trans, network, address)
+	if err != nil {
+		return nil, err
+	}
+	metrics.DialSeconds.ObserveSince(start, action.String())
+	return conn, nil
+}
+
+func (r *Router) dialDirect(ctx context.Context, address string) (io.ReadWriteCloser, error) {
+	start := time.Now()
+	conn, err := r.Dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, &transport.DialError{
+			Code: transport.StatusForError(err),
+			Err:  err,
+		}
+	}
+	metrics.DialSeconds.ObserveSince(start, "direct")
+	return &directConn{conn}, nil
+}
+
+// ResolvedIP returns the IP a connection from Dial reached, which is only
+// known for direct connections.
+func ResolvedIP(conn io.ReadWriteCloser) string {
+	dc, ok := conn.(*directConn)
+	if !ok {
+		return ""
+	}
+	host, _, _ := net.SplitHostPort(dc.RemoteAddr().String())
+	return host
+}
+
+// SupportsDeadlines is true if every transport supports deadlines, as
+// direct connections do.
+func (r *Router) SupportsDeadlines() bool {
+	for _, trans := range r.Transports {
+		if !transport.SupportsDeadlines(trans) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Router) Listen() (transport.Listener, error) {
+	return nil, errors.New("routers can't listen")
+}
+
+// directConn reports the local address of a direct connection the same
+// way a tunneled connection reports the server's.
+type directConn struct {
+	net.Conn
+}
+
+func (c *directConn) Status() *transport.Status {
+	return transport.StatusForAddr(c.LocalAddr())
+}
+
+func (c *directConn) CloseWrite() error {
+	return bridge.CloseWrite(c.Conn)
+}
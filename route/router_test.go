@@ -0,0 +1,86 @@
+package route
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/beefsack/go-under-cover/transport"
+)
+
+func TestRoute(t *testing.T) {
+	rules, err := Parse(strings.NewReader(`
+block domain:ads.example
+direct cidr:192.168.0.0/16
+tunnel:eu domain:example.eu
+direct * 22
+`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	r := NewRouter(map[string]transport.Transport{
+		DefaultTransport: nil,
+		"eu":             nil,
+	})
+	if err := r.SetRules(rules); err != nil {
+		t.Fatalf("SetRules: %v", err)
+	}
+	tests := []struct {
+		host string
+		port uint16
+		want string
+	}{
+		{"tracker.ads.example", 443, "block"},
+		{"192.168.1.10", 80, "direct"},
+		{"www.example.eu", 443, "tunnel:eu"},
+		{"github.com", 22, "direct"},
+		// The first matching rule wins.
+		{"ads.example", 22, "block"},
+		{"github.com", 443, "tunnel"},
+	}
+	for _, tt := range tests {
+		if got := r.Route(tt.host, tt.port).String(); got != tt.want {
+			t.Errorf("%s:%d routed %s, want %s", tt.host, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestSetRulesUnknownTransport(t *testing.T) {
+	r := NewRouter(map[string]transport.Transport{DefaultTransport: nil})
+	rule, _ := ParseRule("tunnel:missing *")
+	rule.Line = 7
+	err := r.SetRules([]*Rule{rule})
+	if err == nil || !strings.Contains(err.Error(), "line 7") {
+		t.Errorf("got error %v, want one for line 7", err)
+	}
+}
+
+type fakeTransport struct {
+	dialed []string
+}
+
+func (f *fakeTransport) Dial(network, address string) (io.ReadWriteCloser, error) {
+	f.dialed = append(f.dialed, network+" "+address)
+	return nil, io.EOF
+}
+
+func (f *fakeTransport) Listen() (transport.Listener, error) {
+	return nil, io.EOF
+}
+
+func TestDial(t *testing.T) {
+	def := &fakeTransport{}
+	r := NewRouter(map[string]transport.Transport{DefaultTransport: def})
+	rules, _ := Parse(strings.NewReader("block domain:blocked.example\ndirect *\n"))
+	r.SetRules(rules)
+
+	_, err := r.Dial("tcp", "blocked.example:80")
+	if code := transport.StatusForError(err); code != transport.StatusDenied {
+		t.Errorf("blocked dial returned %v, want a denied status", err)
+	}
+	// UDP can't go direct, so falls back to the default transport.
+	r.Dial("udp", "dns.example:53")
+	if len(def.dialed) != 1 || def.dialed[0] != "udp dns.example:53" {
+		t.Errorf("default transport dialed %v", def.dialed)
+	}
+}
@@ -0,0 +1,223 @@
+package route
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/beefsack/go-under-cover/policy"
+)
+
+const (
+	ActionTunnel = iota
+	ActionDirect
+	ActionBlock
+)
+
+type Action struct {
+	Kind int
+	// Transport names the transport to tunnel through, the default one if
+	// empty.
+	Transport string
+}
+
+func (a Action) String() string {
+	switch a.Kind {
+	case ActionDirect:
+		return "direct"
+	case ActionBlock:
+		return "block"
+	}
+	if a.Transport != "" {
+		return "tunnel:" + a.Transport
+	}
+	return "tunnel"
+}
+
+// Matcher matches a destination host. ip is set when the host is a literal
+// IP address.
+type Matcher interface {
+	Match(host string, ip net.IP) bool
+	String() string
+}
+
+type Rule struct {
+	Action Action
+	Match  Matcher
+	// Ports restricts the rule to destination ports, or any port if empty.
+	Ports []policy.PortRange
+	// Line is the line the rule was parsed from, for logging.
+	Line int
+}
+
+func (r *Rule) Matches(host string, ip net.IP, port uint16) bool {
+	if !r.Match.Match(host, ip) {
+		return false
+	}
+	if len(r.Ports) == 0 {
+		return true
+	}
+	for _, pr := range r.Ports {
+		if pr.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse reads rules, one per line, in the form:
+//
+//	ACTION MATCH [PORTS]
+//
+// ACTION is direct, block, tunnel or tunnel:NAME. MATCH is * for any host,
+// domain:SUFFIX, glob:PATTERN, regex:EXPR or cidr:NETWORK. PORTS is a comma
+// separated list of ports and ranges such as 80,443,8000-8999. Blank lines
+// and anything after # are ignored.
+func Parse(r io.Reader) ([]*Rule, error) {
+	rules := []*Rule{}
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		rule, err := ParseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		rule.Line = lineNum
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func ParseRule(line string) (*Rule, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, fmt.Errorf("expected ACTION MATCH [PORTS], got %q", line)
+	}
+	rule := &Rule{}
+	var err error
+	if rule.Action, err = parseAction(fields[0]); err != nil {
+		return nil, err
+	}
+	if rule.Match, err = parseMatcher(fields[1]); err != nil {
+		return nil, err
+	}
+	if len(fields) == 3 {
+		if rule.Ports, err = policy.ParsePorts(fields[2]); err != nil {
+			return nil, err
+		}
+		if len(rule.Ports) == 0 {
+			return nil, fmt.Errorf("no ports in %q", fields[2])
+		}
+	}
+	return rule, nil
+}
+
+func parseAction(s string) (Action, error) {
+	switch {
+	case s == "direct":
+		return Action{Kind: ActionDirect}, nil
+	case s == "block":
+		return Action{Kind: ActionBlock}, nil
+	case s == "tunnel":
+		return Action{Kind: ActionTunnel}, nil
+	case strings.HasPrefix(s, "tunnel:") && len(s) > len("tunnel:"):
+		return Action{Kind: ActionTunnel, Transport: s[len("tunnel:"):]}, nil
+	}
+	return Action{}, fmt.Errorf("unknown action %q", s)
+}
+
+func parseMatcher(s string) (Matcher, error) {
+	if s == "*" {
+		return anyMatcher{}, nil
+	}
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("expected TYPE:VALUE match, got %q", s)
+	}
+	value := parts[1]
+	switch parts[0] {
+	case "domain":
+		return domainMatcher(strings.ToLower(strings.TrimPrefix(value, "."))), nil
+	case "glob":
+		if _, err := path.Match(value, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %v", value, err)
+		}
+		return globMatcher(strings.ToLower(value)), nil
+	case "regex":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %v", value, err)
+		}
+		return regexMatcher{re}, nil
+	case "cidr":
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", value, err)
+		}
+		return cidrMatcher{ipNet}, nil
+	}
+	return nil, fmt.Errorf("unknown match type %q", parts[0])
+}
+
+type anyMatcher struct{}
+
+func (anyMatcher) Match(host string, ip net.IP) bool { return true }
+func (anyMatcher) String() string                    { return "*" }
+
+// domainMatcher matches a domain and all of its subdomains.
+type domainMatcher string
+
+func (m domainMatcher) Match(host string, ip net.IP) bool {
+	if ip != nil {
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	suffix := string(m)
+	return host == suffix || strings.HasSuffix(host, "."+suffix)
+}
+
+func (m domainMatcher) String() string { return "domain:" + string(m) }
+
+type globMatcher string
+
+func (m globMatcher) Match(host string, ip net.IP) bool {
+	ok, _ := path.Match(string(m), strings.ToLower(host))
+	return ok
+}
+
+func (m globMatcher) String() string { return "glob:" + string(m) }
+
+type regexMatcher struct {
+	re *regexp.Regexp
+}
+
+func (m regexMatcher) Match(host string, ip net.IP) bool {
+	return m.re.MatchString(host)
+}
+
+func (m regexMatcher) String() string { return "regex:" + m.re.String() }
+
+// cidrMatcher only matches literal IP destinations, as resolving domains
+// locally would leak them outside the tunnel.
+type cidrMatcher struct {
+	ipNet *net.IPNet
+}
+
+func (m cidrMatcher) Match(host string, ip net.IP) bool {
+	return ip != nil && m.ipNet.Contains(ip)
+}
+
+func (m cidrMatcher) String() string { return "cidr:" + m.ipNet.String() }
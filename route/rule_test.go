@@ -0,0 +1,121 @@
+package route
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		line       string
+		wantAction string
+		wantMatch  string
+		wantPorts  int
+		wantErr    bool
+	}{
+		{"direct *", "direct", "*", 0, false},
+		{"block domain:.Example.COM 80,443", "block", "domain:example.com", 2, false},
+		{"tunnel glob:*.internal 8000-8999", "tunnel", "glob:*.internal", 1, false},
+		{"tunnel:eu regex:^api\\. 443", "tunnel:eu", "regex:^api\\.", 1, false},
+		{"direct cidr:10.0.0.0/8", "direct", "cidr:10.0.0.0/8", 0, false},
+		{"direct", "", "", 0, true},
+		{"direct * 80 extra", "", "", 0, true},
+		{"allow *", "", "", 0, true},
+		{"tunnel: *", "", "", 0, true},
+		{"direct host:example.com", "", "", 0, true},
+		{"direct domain:", "", "", 0, true},
+		{"direct glob:[", "", "", 0, true},
+		{"direct regex:(", "", "", 0, true},
+		{"direct cidr:10.0.0.0/33", "", "", 0, true},
+		{"direct * 0-", "", "", 0, true},
+		{"direct * 90-80", "", "", 0, true},
+		{"direct * 70000", "", "", 0, true},
+		{"direct * ,", "", "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			rule, err := ParseRule(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if rule.Action.String() != tt.wantAction {
+				t.Errorf("got action %s, want %s", rule.Action, tt.wantAction)
+			}
+			if rule.Match.String() != tt.wantMatch {
+				t.Errorf("got match %s, want %s", rule.Match, tt.wantMatch)
+			}
+			if len(rule.Ports) != tt.wantPorts {
+				t.Errorf("got %d port ranges, want %d", len(rule.Ports), tt.wantPorts)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	input := `# routing rules
+direct cidr:192.168.0.0/16
+
+block domain:ads.example   # trailing comment
+tunnel:eu *
+`
+	rules, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	wantLines := []int{2, 4, 5}
+	if len(rules) != len(wantLines) {
+		t.Fatalf("got %d rules, want %d", len(rules), len(wantLines))
+	}
+	for i, rule := range rules {
+		if rule.Line != wantLines[i] {
+			t.Errorf("rule %d on line %d, want %d", i, rule.Line, wantLines[i])
+		}
+	}
+
+	_, err = Parse(strings.NewReader("direct *\n\nbogus *\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 3:") {
+		t.Errorf("got error %v, want one for line 3", err)
+	}
+}
+
+func TestMatchers(t *testing.T) {
+	tests := []struct {
+		rule string
+		host string
+		port uint16
+		want bool
+	}{
+		{"direct *", "anything", 1, true},
+		{"direct domain:example.com", "example.com", 80, true},
+		{"direct domain:example.com", "WWW.Example.com.", 80, true},
+		{"direct domain:example.com", "badexample.com", 80, false},
+		{"direct domain:example.com", "93.184.216.34", 80, false},
+		{"direct glob:*.corp", "git.corp", 22, true},
+		{"direct glob:*.corp", "git.corp.example", 22, false},
+		{"direct regex:^10\\.", "10.1.2.3", 80, true},
+		{"direct cidr:10.0.0.0/8", "10.1.2.3", 80, true},
+		{"direct cidr:10.0.0.0/8", "11.1.2.3", 80, false},
+		// Domains are never resolved locally to match a CIDR.
+		{"direct cidr:127.0.0.0/8", "localhost", 80, false},
+		{"direct cidr:2001:db8::/32", "2001:db8::1", 443, true},
+		{"direct * 80,443", "x", 443, true},
+		{"direct * 80,443", "x", 8080, false},
+		{"direct * 8000-8999", "x", 8999, true},
+		{"direct * 8000-8999", "x", 9000, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule+" "+tt.host, func(t *testing.T) {
+			rule, err := ParseRule(tt.rule)
+			if err != nil {
+				t.Fatalf("ParseRule: %v", err)
+			}
+			if got := rule.Matches(tt.host, net.ParseIP(tt.host), tt.port); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,183 +1,260 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
+	"context"
 	"flag"
 	"fmt"
-	"log"
-	"math/big"
-	"net"
-	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/beefsack/go-under-cover/admin"
+	"github.com/beefsack/go-under-cover/audit"
 	"github.com/beefsack/go-under-cover/bridge"
+	"github.com/beefsack/go-under-cover/config"
 	"github.com/beefsack/go-under-cover/llog"
-	"github.com/gorilla/websocket"
-	"github.com/manveru/faker"
+	"github.com/beefsack/go-under-cover/session"
+	"github.com/beefsack/go-under-cover/socks"
+	"github.com/beefsack/go-under-cover/transport"
+	"github.com/beefsack/go-under-cover/undercover"
 )
 
-const (
-	DefaultPrivFile = "key.pem"
-	DefaultCertFile = "cert.pem"
-)
+var logger = llog.Named("server")
 
-var fak *faker.Faker
+// auditDrainTimeout is how long sessions closed by shutting down have to
+// write their audit records.
+const auditDrainTimeout = 5 * time.Second
 
-func init() {
-	var err error
-	fak, err = faker.New("en")
-	if err != nil {
-		log.Fatalf("failed to create faker: %v", err)
+func main() {
+	args := os.Args[1:]
+	validate := len(args) > 0 && args[0] == "validate"
+	if validate {
+		args = args[1:]
 	}
-}
-
-func genKey() (*rsa.PrivateKey, error) {
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate private key: %v", err)
-	}
-	file, err := os.OpenFile(
-		DefaultPrivFile,
-		os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
-		0600,
+	var (
+		configFile string
+		cfg        = config.DefaultServer()
+		allow      string
+		deny       string
+		userAllow  userAllowFlag
 	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open %s: %v", DefaultPrivFile, err)
+	flag.StringVar(&configFile, "config", "", "a YAML config file, any flags given override it")
+	flag.StringVar(&cfg.Listen, "listen", cfg.Listen, "the local address to listen on")
+	flag.IntVar(&cfg.Log.Level, "v", cfg.Log.Level, "the level to log, 1-5")
+	flag.StringVar(&cfg.Log.Format, "log-format", cfg.Log.Format, "the log format, text or json")
+	flag.DurationVar(&cfg.Timeouts.Handshake, "handshake-timeout", cfg.Timeouts.Handshake, "how long TLS and WebSocket handshakes may take, forever if 0")
+	flag.DurationVar(&cfg.Timeouts.Dial, "dial-timeout", cfg.Timeouts.Dial, "how long connecting to a destination may take, forever if 0")
+	flag.DurationVar(&cfg.Timeouts.Idle, "idle-timeout", cfg.Timeouts.Idle, "how long a tunnel may go without traffic, forever if 0")
+	flag.DurationVar(&cfg.Timeouts.Linger, "linger", cfg.Timeouts.Linger, "how long to keep a half-closed tunnel open, forever if 0")
+	flag.StringVar(&cfg.Audit.File, "audit", "", "a file to write a JSON record of every session to")
+	flag.StringVar(&cfg.Admin, "admin", "", "an address to serve /metrics and the session API on")
+	flag.StringVar(&cfg.AdminToken, "admin-token", "", "a bearer token the admin API requires, needed unless -admin is loopback")
+	flag.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "how long to wait for tunnels to finish on SIGTERM")
+	flag.StringVar(&cfg.TLS.Cert, "cert", cfg.TLS.Cert, "the certificate file, generated with -tls-key if neither exist")
+	flag.StringVar(&cfg.TLS.Key, "tls-key", cfg.TLS.Key, "the private key file for the certificate")
+	flag.StringVar(&cfg.Auth.Key, "key", "", "a pre-shared key clients must authenticate with")
+	flag.StringVar(&cfg.Auth.KeysFile, "keys", "", "a file of user:key lines clients must authenticate with")
+	flag.StringVar(&allow, "allow", "", "comma separated CIDRs clients may connect to even if denied")
+	flag.StringVar(&deny, "deny", "", "comma separated CIDRs clients may not connect to, as well as private and local ranges")
+	flag.StringVar(&cfg.Policy.Ports, "ports", "", "comma separated ports and ranges clients may connect to, any if empty")
+	flag.Var(&userAllow, "allow-user", "user=CIDR,... to allow for an authenticated user, may be repeated")
+	flag.StringVar(&cfg.Tunnel.Path, "path", cfg.Tunnel.Path, "the URL path clients open the tunnel on")
+	flag.StringVar(&cfg.Decoy.Dir, "decoy-dir", "", "a directory of static files to serve to anyone who isn't a client")
+	flag.StringVar(&cfg.Decoy.Upstream, "decoy-upstream", "", "a URL of a web app to proxy anyone who isn't a client to")
+	flag.StringVar(&cfg.Decoy.ServerHeader, "server-header", cfg.Decoy.ServerHeader, "the Server header to send on decoy responses")
+	flag.StringVar(&cfg.Egress.Address, "egress", "", "a SOCKS5 proxy to send tunnels through, such as Tor, rather than connecting directly")
+	flag.BoolVar(&cfg.Egress.RemoteDNS, "egress-remote-dns", false, "let domains which can't be resolved locally through for the egress proxy to resolve")
+	flag.CommandLine.Parse(args)
+	if configFile != "" {
+		flagCfg := cfg
+		var err error
+		if cfg, err = config.LoadServer(configFile); err != nil {
+			logger.Fatal("failed loading config: %v", err)
+		}
+		overrideServer(cfg, flagCfg)
 	}
-	if err := pem.Encode(file, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(priv),
-	}); err != nil {
-		return nil, fmt.Errorf("failed to write %s: %v", DefaultPrivFile, err)
+	if allow != "" {
+		cfg.Policy.Allow = strings.Split(allow, ",")
 	}
-	if err := file.Close(); err != nil {
-		return nil, fmt.Errorf("failed to close %s: %v", DefaultPrivFile, err)
+	if deny != "" {
+		cfg.Policy.Deny = strings.Split(deny, ",")
 	}
-	return priv, nil
-}
-
-func genCert(priv *rsa.PrivateKey) error {
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
-	if err != nil {
-		return fmt.Errorf("failed to generate a serial number: %v", err)
+	if userAllow != nil {
+		cfg.Policy.Users = userAllow
 	}
-
-	template := x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			Organization: []string{fak.CompanyName()},
-		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(7300 * 24 * time.Hour),
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
+	if err := cfg.Validate(); err != nil {
+		if validate {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		logger.Fatal("invalid config:\n%v", err)
 	}
-
-	cert, err := x509.CreateCertificate(
-		rand.Reader,
-		&template,
-		&template,
-		&priv.PublicKey,
-		priv,
-	)
-	if err != nil {
-		return fmt.Errorf("failed to generate certificate: %v", err)
+	if validate {
+		fmt.Println("config is valid")
+		return
 	}
+	cfg.Log.Apply()
 
-	file, err := os.OpenFile(
-		DefaultCertFile,
-		os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
-		0600,
-	)
-	if err != nil {
-		return fmt.Errorf("failed to open %s: %v", DefaultCertFile, err)
+	opts := undercover.DefaultServerOptions()
+	opts.Listen = cfg.Listen
+	opts.CertFile = cfg.TLS.Cert
+	opts.KeyFile = cfg.TLS.Key
+	opts.Path = cfg.Tunnel.Path
+	opts.Subprotocol = cfg.Tunnel.Subprotocol
+	opts.BufferSize = cfg.Tunnel.BufferSize
+	opts.HandshakeTimeout = cfg.Timeouts.Handshake
+	opts.DialTimeout = cfg.Timeouts.Dial
+	opts.Bridge = &bridge.Options{
+		Linger:      cfg.Timeouts.Linger,
+		IdleTimeout: cfg.Timeouts.Idle,
 	}
-	if err := pem.Encode(file, &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: cert,
-	}); err != nil {
-		return fmt.Errorf("failed to write %s: %v", DefaultCertFile, err)
-	}
-	if err := file.Close(); err != nil {
-		return fmt.Errorf("failed to close %s: %v", DefaultCertFile, err)
+	opts.Logger = logger
+	var err error
+	if opts.Policy, err = buildPolicy(cfg.Policy); err != nil {
+		logger.Fatal("invalid policy: %v", err)
 	}
-	return nil
-}
-
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin:     func(r *http.Request) bool { return true },
-}
-
-func main() {
-	var (
-		listenAddr string
-		logLevel   int
-	)
-	flag.StringVar(&listenAddr, "listen", ":1443", "the local address to listen on")
-	flag.IntVar(&logLevel, "v", llog.LevelInfo, "the level to log, 1-5")
-	flag.Parse()
-	llog.Default.Level = logLevel
-
-	_, privErr := os.Stat(DefaultPrivFile)
-	_, certErr := os.Stat(DefaultCertFile)
-	if os.IsNotExist(privErr) && os.IsNotExist(certErr) {
-		priv, err := genKey()
-		if err != nil {
-			llog.Fatal("failed generating private key: %v", err)
+	if cfg.Auth.Enabled() {
+		keys := map[string][]byte{}
+		if cfg.Auth.KeysFile != "" {
+			if keys, err = loadKeys(cfg.Auth.KeysFile); err != nil {
+				logger.Fatal("failed loading keys: %v", err)
+			}
+		}
+		for user, key := range cfg.Auth.Keys {
+			keys[user] = []byte(key)
 		}
-		if err := genCert(priv); err != nil {
-			llog.Fatal("failed generating certificate: %v", err)
+		if cfg.Auth.Key != "" {
+			keys[""] = []byte(cfg.Auth.Key)
 		}
+		opts.Auth = transport.NewAuthenticator(keys)
+	} else {
+		logger.Warn("client authentication is disabled, anyone can use this server")
+	}
+	if opts.Decoy, err = undercover.NewDecoy(
+		cfg.Decoy.Dir,
+		cfg.Decoy.Upstream,
+		cfg.Decoy.ServerHeader,
+	); err != nil {
+		logger.Fatal("invalid decoy: %v", err)
+	}
+	if cfg.Egress.Address != "" {
+		egress := socks.NewClient(cfg.Egress.Address, byte(cfg.Egress.Socks))
+		egress.Username = cfg.Egress.User
+		egress.Password = cfg.Egress.Password
+		egress.Dialer.Timeout = cfg.Timeouts.Dial
+		egress.HandshakeTimeout = cfg.Timeouts.Handshake
+		opts.Egress = egress
+		opts.EgressRemoteDNS = cfg.Egress.RemoteDNS
+		logger.Info("sending tunnels through %s", cfg.Egress.Address)
 	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(200)
-		w.Write([]byte("fart"))
-	})
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		llog.Debug("WS /ws %s", r.RemoteAddr)
-		values := r.URL.Query()
-		host := values.Get("host")
-		port := values.Get("port")
-		if host == "" || port == "" {
-			return
+	var sink *audit.FileSink
+	if cfg.Audit.File != "" {
+		if sink, err = audit.NewFileSink(cfg.Audit.File, cfg.Audit.MaxSize, cfg.Audit.MaxAge); err != nil {
+			logger.Fatal("failed to open audit log: %v", err)
 		}
+		session.Default.OnDone = audit.Hook(sink)
+	}
+	if cfg.Admin != "" {
+		go func() {
+			logger.Info("serving admin on %s", cfg.Admin)
+			if err := admin.ListenAndServe(cfg.Admin, cfg.AdminToken); err != nil {
+				logger.Fatal("failed to serve admin: %v", err)
+			}
+		}()
+	}
 
-		ws, err := upgrader.Upgrade(w, r, http.Header{
-			"Sec-Websocket-Protocol": {"chat"},
-		})
-		defer ws.Close()
-		if err != nil {
-			llog.Warn("failed upgrading connection to websocket: %v", err)
-			return
-		}
-		conn := ws.UnderlyingConn()
+	srv := undercover.NewServer(opts)
+	if err := srv.Start(context.Background()); err != nil {
+		logger.Fatal("%v", err)
+	}
 
-		target, err := net.Dial("tcp", fmt.Sprintf("%s:%s", host, port))
-		if err != nil {
-			return
+	shutdown := make(chan struct{})
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		logger.Info("received %s, shutting down", <-stop)
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			logger.Warn("failed to shut down cleanly: %v", err)
 		}
-		defer target.Close()
+		close(shutdown)
+	}()
 
-		bridge.Bridge(conn, target)
-	})
+	if err := srv.Wait(); err != nil {
+		logger.Fatal("%v", err)
+	}
+	<-shutdown
+	if sink != nil {
+		closeAudit(sink)
+	}
+}
 
-	llog.Info("listening on %s", listenAddr)
-	if err := http.ListenAndServeTLS(
-		listenAddr,
-		DefaultCertFile,
-		DefaultPrivFile,
-		nil,
-	); err != nil {
-		llog.Fatal("failed to start server: %v", err)
+// closeAudit closes the audit log once the sessions still finishing after
+// shutdown have written their records.
+func closeAudit(sink *audit.FileSink) {
+	ctx, cancel := context.WithTimeout(context.Background(), auditDrainTimeout)
+	defer cancel()
+	if err := session.Default.Wait(ctx); err != nil {
+		logger.Warn("closing audit log with sessions still active: %v", err)
 	}
+	if err := sink.Close(); err != nil {
+		logger.Warn("failed to close audit log: %v", err)
+	}
+}
+
+// overrideServer copies the values of flags which were given on the command
+// line from flagCfg over cfg.
+func overrideServer(cfg, flagCfg *config.Server) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = flagCfg.Listen
+		case "v":
+			cfg.Log.Level = flagCfg.Log.Level
+		case "log-format":
+			cfg.Log.Format = flagCfg.Log.Format
+		case "handshake-timeout":
+			cfg.Timeouts.Handshake = flagCfg.Timeouts.Handshake
+		case "dial-timeout":
+			cfg.Timeouts.Dial = flagCfg.Timeouts.Dial
+		case "idle-timeout":
+			cfg.Timeouts.Idle = flagCfg.Timeouts.Idle
+		case "linger":
+			cfg.Timeouts.Linger = flagCfg.Timeouts.Linger
+		case "audit":
+			cfg.Audit.File = flagCfg.Audit.File
+		case "admin":
+			cfg.Admin = flagCfg.Admin
+		case "admin-token":
+			cfg.AdminToken = flagCfg.AdminToken
+		case "shutdown-timeout":
+			cfg.ShutdownTimeout = flagCfg.ShutdownTimeout
+		case "cert":
+			cfg.TLS.Cert = flagCfg.TLS.Cert
+		case "tls-key":
+			cfg.TLS.Key = flagCfg.TLS.Key
+		case "key":
+			cfg.Auth.Key = flagCfg.Auth.Key
+		case "keys":
+			cfg.Auth.KeysFile = flagCfg.Auth.KeysFile
+		case "ports":
+			cfg.Policy.Ports = flagCfg.Policy.Ports
+		case "path":
+			cfg.Tunnel.Path = flagCfg.Tunnel.Path
+		case "decoy-dir":
+			cfg.Decoy.Dir = flagCfg.Decoy.Dir
+		case "decoy-upstream":
+			cfg.Decoy.Upstream = flagCfg.Decoy.Upstream
+		case "egress":
+			cfg.Egress.Address = flagCfg.Egress.Address
+		case "egress-remote-dns":
+			cfg.Egress.RemoteDNS = flagCfg.Egress.RemoteDNS
+		case "server-header":
+			cfg.Decoy.ServerHeader = flagCfg.Decoy.ServerHeader
+		}
+	})
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/beefsack/go-under-cover/config"
+	"github.com/beefsack/go-under-cover/policy"
+)
+
+// userAllowFlag collects repeated -allow-user user=CIDR,... flags.
+type userAllowFlag map[string][]string
+
+func (f *userAllowFlag) String() string {
+	return ""
+}
+
+func (f *userAllowFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected user=CIDR,..., got %s", value)
+	}
+	if *f == nil {
+		*f = userAllowFlag{}
+	}
+	(*f)[parts[0]] = append((*f)[parts[0]], strings.Split(parts[1], ",")...)
+	return nil
+}
+
+func buildPolicy(p config.Policy) (*policy.Policy, error) {
+	pol := policy.New()
+	allowNets, err := policy.ParseCIDRs(p.Allow...)
+	if err != nil {
+		return nil, err
+	}
+	pol.Allow = allowNets
+	denyNets, err := policy.ParseCIDRs(p.Deny...)
+	if err != nil {
+		return nil, err
+	}
+	pol.Deny = append(pol.Deny, denyNets...)
+	if pol.Ports, err = policy.ParsePorts(p.Ports); err != nil {
+		return nil, err
+	}
+	for user, cidrs := range p.Users {
+		nets, err := policy.ParseCIDRs(cidrs...)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %v", user, err)
+		}
+		up := *pol
+		up.Allow = append(append([]*net.IPNet{}, pol.Allow...), nets...)
+		up.Users = nil
+		pol.Users[user] = &up
+	}
+	return pol, nil
+}
@@ -0,0 +1,262 @@
+// Package session keeps a registry of live proxied connections so they can
+// be listed and closed while running.
+package session
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/beefsack/go-under-cover/bridge"
+	"github.com/beefsack/go-under-cover/metrics"
+)
+
+var ErrNotFound = errors.New("session not found")
+
+// waitPollInterval is how often Wait checks for sessions finishing.
+const waitPollInterval = 50 * time.Millisecond
+
+// Info describes a session at a point in time.
+type Info struct {
+	ID uint64 `json:"id"`
+	// Kind is the protocol the session came in on, such as socks or http.
+	Kind        string `json:"kind"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	User        string `json:"user"`
+	// SocksVersion is 4, 4a or 5 for SOCKS sessions.
+	SocksVersion string `json:"socks_version,omitempty"`
+	// ResolvedIP is the address the destination resolved to, if known.
+	ResolvedIP string `json:"resolved_ip,omitempty"`
+	// Transport is how the session leaves this process.
+	Transport string    `json:"transport"`
+	Start     time.Time `json:"start"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+}
+
+// Session is a live proxied connection, which also feeds the connection and
+// byte metrics.
+type Session struct {
+	info     Info
+	up, down int64
+	tracker  *metrics.Tracker
+	closers  []io.Closer
+	reg      *Registry
+	once     sync.Once
+
+	mu     sync.Mutex
+	reason string
+}
+
+func (s *Session) Info() Info {
+	info := s.info
+	info.BytesUp = atomic.LoadInt64(&s.up)
+	info.BytesDown = atomic.LoadInt64(&s.down)
+	return info
+}
+
+func (s *Session) Up(n int) {
+	atomic.AddInt64(&s.up, int64(n))
+	s.tracker.Up(n)
+}
+
+func (s *Session) Down(n int) {
+	atomic.AddInt64(&s.down, int64(n))
+	s.tracker.Down(n)
+}
+
+// Wrap counts bytes written to the destination side of the session as up,
+// and bytes read from it as down.
+func (s *Session) Wrap(dst io.ReadWriter) io.ReadWriter {
+	return &countingReadWriter{dst, s}
+}
+
+// Close closes both sides of the session, ending the bridge between them.
+func (s *Session) Close() error {
+	s.setReason("closed")
+	var err error
+	for _, c := range s.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// End records why the bridge for the session finished, unless the session
+// was closed.
+func (s *Session) End(res bridge.Result) {
+	s.EndErr(res.Err())
+}
+
+// EndErr records why a session which isn't a bridge, such as a UDP
+// association, finished.
+func (s *Session) EndErr(err error) {
+	switch {
+	case err == nil:
+		s.setReason("done")
+	case errors.Is(err, bridge.ErrIdleTimeout):
+		s.setReason("idle timeout")
+	case errors.Is(err, context.Canceled):
+		s.setReason("shutdown")
+	default:
+		s.setReason(err.Error())
+	}
+}
+
+func (s *Session) setReason(reason string) {
+	s.mu.Lock()
+	if s.reason == "" {
+		s.reason = reason
+	}
+	s.mu.Unlock()
+}
+
+// Done removes the session from the registry once it has ended.
+func (s *Session) Done() {
+	s.once.Do(func() {
+		s.reg.mu.Lock()
+		delete(s.reg.sessions, s.info.ID)
+		s.reg.mu.Unlock()
+		s.tracker.Done()
+		if s.reg.OnDone != nil {
+			s.mu.Lock()
+			reason := s.reason
+			s.mu.Unlock()
+			s.reg.OnDone(s.Info(), reason)
+		}
+	})
+}
+
+type Registry struct {
+	// OnDone is called with the final state of each session as it ends, and
+	// why it ended.
+	OnDone func(info Info, reason string)
+
+	mu       sync.Mutex
+	nextID   uint64
+	sessions map[uint64]*Session
+}
+
+// Default is the registry used by the proxies in this module.
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{
+		sessions: map[uint64]*Session{},
+	}
+}
+
+// Start registers a session until Done is called on it. The closers are
+// closed to kill the session, and would usually be both of its ends.
+func (r *Registry) Start(info Info, closers ...io.Closer) *Session {
+	_, portStr, _ := net.SplitHostPort(info.Destination)
+	port, _ := strconv.ParseUint(portStr, 10, 16)
+	s := &Session{
+		info:    info,
+		tracker: metrics.Track(info.Kind, info.User, uint16(port)),
+		closers: closers,
+		reg:     r,
+	}
+	s.info.Start = time.Now()
+	r.mu.Lock()
+	r.nextID++
+	s.info.ID = r.nextID
+	r.sessions[s.info.ID] = s
+	r.mu.Unlock()
+	return s
+}
+
+// List returns every live session, oldest first.
+func (r *Registry) List() []Info {
+	r.mu.Lock()
+	infos := make([]Info, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		infos = append(infos, s.Info())
+	}
+	r.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// Wait blocks until every session has finished, or ctx is done.
+func (r *Registry) Wait(ctx context.Context) error {
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+	for {
+		r.mu.Lock()
+		n := len(r.sessions)
+		r.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Registry) Close(id uint64) error {
+	r.mu.Lock()
+	s, ok := r.sessions[id]
+	r.mu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	return s.Close()
+}
+
+// CloseUser closes every session for user, returning how many there were.
+func (r *Registry) CloseUser(user string) int {
+	r.mu.Lock()
+	var matched []*Session
+	for _, s := range r.sessions {
+		if s.info.User == user {
+			matched = append(matched, s)
+		}
+	}
+	r.mu.Unlock()
+	for _, s := range matched {
+		s.Close()
+	}
+	return len(matched)
+}
+
+type countingReadWriter struct {
+	io.ReadWriter
+	s *Session
+}
+
+func (c *countingReadWriter) Read(p []byte) (int, error) {
+	n, err := c.ReadWriter.Read(p)
+	c.s.Down(n)
+	return n, err
+}
+
+func (c *countingReadWriter) Write(p []byte) (int, error) {
+	n, err := c.ReadWriter.Write(p)
+	c.s.Up(n)
+	return n, err
+}
+
+func (c *countingReadWriter) CloseWrite() error {
+	return bridge.CloseWrite(c.ReadWriter)
+}
+
+func (c *countingReadWriter) Close() error {
+	if closer, ok := c.ReadWriter.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
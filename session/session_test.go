@@ -0,0 +1,130 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beefsack/go-under-cover/bridge"
+	"github.com/beefsack/go-under-cover/metrics"
+)
+
+func TestEndReason(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		close bool
+		want  string
+	}{
+		{"done", nil, false, "done"},
+		{"idle", bridge.ErrIdleTimeout, false, "idle timeout"},
+		{"shutdown", context.Canceled, false, "shutdown"},
+		{"failed", errors.New("broken pipe"), false, "broken pipe"},
+		// Closing first keeps the reason from the error it causes.
+		{"closed", errors.New("use of closed connection"), true, "closed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRegistry()
+			var reason string
+			r.OnDone = func(info Info, why string) { reason = why }
+			s := r.Start(Info{Kind: "test", Destination: "example.com:80"})
+			if tt.close {
+				s.Close()
+			}
+			s.EndErr(tt.err)
+			s.Done()
+			if reason != tt.want {
+				t.Errorf("ended with %q, want %q", reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestWait(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait without sessions: %v", err)
+	}
+	s := r.Start(Info{Kind: "test"})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := r.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Wait with a live session returned %v", err)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		s.Done()
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := r.Wait(ctx); err != nil {
+		t.Errorf("Wait after the session finished returned %v", err)
+	}
+}
+
+// scrape returns the value of a series from the default metrics, or zero
+// if it hasn't been written.
+func scrape(t *testing.T, name string) float64 {
+	t.Helper()
+	w := httptest.NewRecorder()
+	metrics.Default.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, name+" ") {
+			v, err := strconv.ParseFloat(strings.TrimPrefix(line, name+" "), 64)
+			if err != nil {
+				t.Fatalf("failed to parse %q: %v", line, err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+func TestSessionMetrics(t *testing.T) {
+	tests := []struct {
+		name string
+		want float64
+	}{
+		{`undercover_active_connections{kind="metrics-test"}`, 0},
+		{`undercover_user_connections_total{user="metrics-user"}`, 1},
+		{`undercover_user_bytes_total{user="metrics-user",direction="up"}`, 7},
+		{`undercover_user_bytes_total{user="metrics-user",direction="down"}`, 8},
+		{`undercover_port_connections_total{port="8443"}`, 1},
+		{`undercover_port_bytes_total{port="8443",direction="up"}`, 7},
+	}
+	before := map[string]float64{}
+	for _, tt := range tests {
+		before[tt.name] = scrape(t, tt.name)
+	}
+	s := NewRegistry().Start(Info{
+		Kind:        "metrics-test",
+		User:        "metrics-user",
+		Destination: "example.com:8443",
+	})
+	active := `undercover_active_connections{kind="metrics-test"}`
+	if got := scrape(t, active) - before[active]; got != 1 {
+		t.Errorf("%s rose by %v while active, want 1", active, got)
+	}
+	dst := struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader("response"), &bytes.Buffer{}}
+	conn := s.Wrap(dst)
+	conn.Write([]byte("request"))
+	io.ReadAll(conn)
+	s.EndErr(nil)
+	s.Done()
+
+	for _, tt := range tests {
+		if got := scrape(t, tt.name) - before[tt.name]; got != tt.want {
+			t.Errorf("%s rose by %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Package sniff splits a listener into several, choosing one for each
+// connection by peeking at the first byte the client sends.
+package sniff
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/beefsack/go-under-cover/bridge"
+	"github.com/beefsack/go-under-cover/llog"
+)
+
+var logger = llog.Named("sniff")
+
+const DefaultTimeout = 10 * time.Second
+
+var ErrClosed = errors.New("listener closed")
+
+// Matcher reports whether a connection starting with first belongs to a
+// listener.
+type Matcher func(first byte) bool
+
+// SOCKS matches SOCKS4, SOCKS4A and SOCKS5 requests.
+func SOCKS(first byte) bool {
+	return first == 0x04 || first == 0x05
+}
+
+// HTTP matches HTTP requests, which start with an upper case method.
+func HTTP(first byte) bool {
+	return first >= 'A' && first <= 'Z'
+}
+
+type Mux struct {
+	ln net.Listener
+	// Timeout is how long a client has to send its first byte.
+	Timeout time.Duration
+
+	listeners []*listener
+	done      chan struct{}
+	once      sync.Once
+}
+
+func New(ln net.Listener) *Mux {
+	return &Mux{
+		ln:      ln,
+		Timeout: DefaultTimeout,
+		done:    make(chan struct{}),
+	}
+}
+
+// Match returns a listener for connections matching m. Matchers are tried
+// in the order they were added. It must be called before Serve.
+func (m *Mux) Match(match Matcher) net.Listener {
+	l := &listener{
+		mux:   m,
+		match: match,
+		conns: make(chan net.Conn),
+	}
+	m.listeners = append(m.listeners, l)
+	return l
+}
+
+// Serve accepts connections and hands them to the matching listener until
+// the underlying listener is closed or the Mux is. Other accept errors, such
+// as running out of file descriptors, are retried with a backoff.
+func (m *Mux) Serve() error {
+	defer m.Close()
+	var delay time.Duration
+	for {
+		conn, err := m.ln.Accept()
+		if err != nil {
+			select {
+			case <-m.done:
+				return ErrClosed
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			logger.Warn("failed to accept connection, retrying in %v: %v", delay, err)
+			select {
+			case <-time.After(delay):
+			case <-m.done:
+				return ErrClosed
+			}
+			continue
+		}
+		delay = 0
+		go m.dispatch(conn)
+	}
+}
+
+func (m *Mux) Close() error {
+	var err error
+	m.once.Do(func() {
+		close(m.done)
+		err = m.ln.Close()
+	})
+	return err
+}
+
+func (m *Mux) dispatch(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(m.Timeout))
+	first, err := r.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		logger.Debug("failed to sniff connection from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	for _, l := range m.listeners {
+		if !l.match(first[0]) {
+			continue
+		}
+		select {
+		case l.conns <- &peekedConn{conn, r}:
+		case <-m.done:
+			conn.Close()
+		}
+		return
+	}
+	logger.Debug(
+		"no protocol matched connection from %s starting with 0x%02x",
+		conn.RemoteAddr(),
+		first[0],
+	)
+	conn.Close()
+}
+
+type listener struct {
+	mux   *Mux
+	match Matcher
+	conns chan net.Conn
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.mux.done:
+		return nil, ErrClosed
+	}
+}
+
+// Close closes the whole Mux, as the underlying listener is shared.
+func (l *listener) Close() error {
+	return l.mux.Close()
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.mux.ln.Addr()
+}
+
+// peekedConn reads the bytes buffered while sniffing before the rest of the
+// connection.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *peekedConn) CloseWrite() error {
+	return bridge.CloseWrite(c.Conn)
+}
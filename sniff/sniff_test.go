@@ -0,0 +1,117 @@
+package sniff
+
+import (
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyListener fails its first Accept with a temporary error.
+type flakyListener struct {
+	net.Listener
+	once sync.Once
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	var err error
+	l.once.Do(func() {
+		err = &net.OpError{Op: "accept", Net: "tcp", Err: syscall.ECONNABORTED}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l.Listener.Accept()
+}
+
+// startMux serves a Mux matching SOCKS and then HTTP on loopback.
+func startMux(t *testing.T, timeout time.Duration) (string, net.Listener, net.Listener) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	m := New(&flakyListener{Listener: ln})
+	m.Timeout = timeout
+	socks := m.Match(SOCKS)
+	http := m.Match(HTTP)
+	served := make(chan error, 1)
+	go func() {
+		served <- m.Serve()
+	}()
+	t.Cleanup(func() {
+		m.Close()
+		if err := <-served; err != ErrClosed {
+			t.Errorf("Serve returned %v, want ErrClosed", err)
+		}
+	})
+	return ln.Addr().String(), socks, http
+}
+
+func TestDispatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		wantHTTP bool
+	}{
+		{"socks4", "\x04\x01\x00\x50\xc0\x00\x02\x01\x00", false},
+		{"socks5", "\x05\x01\x00", false},
+		{"http", "GET / HTTP/1.1\r\n\r\n", true},
+	}
+	addr, socks, http := startMux(t, time.Second)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			defer client.Close()
+			client.Write([]byte(tt.data))
+			l := socks
+			if tt.wantHTTP {
+				l = http
+			}
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatalf("Accept: %v", err)
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			got := make([]byte, len(tt.data))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+			if string(got) != tt.data {
+				t.Errorf("got %q, want %q", got, tt.data)
+			}
+		})
+	}
+}
+
+func TestUnmatchedClosed(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"unknown first byte", "\x16\x03\x01"},
+		// Sends nothing, so sniffing times out.
+		{"peek timeout", ""},
+	}
+	addr, _, _ := startMux(t, 50*time.Millisecond)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			defer client.Close()
+			client.Write([]byte(tt.data))
+			client.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+				t.Errorf("read returned %v, want EOF", err)
+			}
+		})
+	}
+}
@@ -24,9 +24,25 @@ func Decode(typ byte, in []byte) (Addr, error) {
 	case ATypDomain:
 		return DecodeDomain(in)
 	default:
-		return nil, fmt.Errorf("unknown address type 0x%d", typ)
+		return nil, fmt.Errorf("unknown address type 0x%02x", typ)
 	}
-	return nil, nil
+}
+
+// ParseAddr parses an IP address or falls back to treating the input as a
+// domain.
+func ParseAddr(input string) Addr {
+	ip := net.ParseIP(input)
+	if ip == nil {
+		return AddrDomain(input)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		addr := AddrIPv4{}
+		copy(addr[:], ip4)
+		return addr
+	}
+	addr := AddrIPv6{}
+	copy(addr[:], ip.To16())
+	return addr
 }
 
 func DecodeIPv4(in []byte) (addr AddrIPv4, err error) {
@@ -105,15 +121,15 @@ func (addr AddrIPv6) Encode() []byte {
 }
 
 func (addr AddrIPv6) ToIPv4() (AddrIPv4, error) {
-	return DecodeIPv4(addr[2:5])
+	ip4 := net.IP(addr[:]).To4()
+	if ip4 == nil {
+		return AddrIPv4{}, fmt.Errorf("%s is not an IPv4 address", addr)
+	}
+	return DecodeIPv4(ip4)
 }
 
 func (addr AddrIPv6) String() string {
-	parts := make([]string, 8)
-	for i := 0; i < 8; i++ {
-		parts[i] = fmt.Sprintf("%x", addr[i*2:i*2+1])
-	}
-	return strings.Join(parts, ":")
+	return net.IP(addr[:]).String()
 }
 
 type AddrDomain []byte
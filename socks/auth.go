@@ -0,0 +1,92 @@
+package socks
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	MethodNoAuth       byte = 0x00
+	MethodUserPass     byte = 0x02
+	MethodNoAcceptable byte = 0xFF
+
+	userPassVersion byte = 0x01
+	userPassSuccess byte = 0x00
+	userPassFailure byte = 0x01
+)
+
+// CredentialChecker reports whether a SOCKS5 username and password are valid.
+type CredentialChecker func(username, password string) bool
+
+// UserIDChecker reports whether a SOCKS4 USERID may use the proxy.
+type UserIDChecker func(userID string) bool
+
+// StaticCredentials checks credentials against a map of usernames to
+// passwords.
+func StaticCredentials(users map[string]string) CredentialChecker {
+	return func(username, password string) bool {
+		expected, ok := users[username]
+		if !ok {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+	}
+}
+
+// AllowUserIDs only allows the given USERIDs. With no IDs every request is
+// rejected.
+func AllowUserIDs(ids ...string) UserIDChecker {
+	allowed := map[string]bool{}
+	for _, id := range ids {
+		allowed[id] = true
+	}
+	return func(userID string) bool {
+		return allowed[userID]
+	}
+}
+
+// negotiateUserPass runs the RFC 1929 sub-negotiation and returns the
+// authenticated username.
+func negotiateUserPass(conn io.ReadWriter, check CredentialChecker) (string, error) {
+	var ver byte
+	if err := binary.Read(conn, ByteOrder, &ver); err != nil {
+		return "", fmt.Errorf("failed to read auth VER octet: %v", err)
+	}
+	if ver != userPassVersion {
+		return "", fmt.Errorf("incorrect auth VER, expected 0x01, received 0x%x", ver)
+	}
+	username, err := readLenString(conn)
+	if err != nil {
+		return "", fmt.Errorf("failed to read UNAME: %v", err)
+	}
+	password, err := readLenString(conn)
+	if err != nil {
+		return "", fmt.Errorf("failed to read PASSWD: %v", err)
+	}
+	if !check(username, password) {
+		conn.Write([]byte{userPassVersion, userPassFailure})
+		return "", fmt.Errorf("invalid credentials for %s", username)
+	}
+	if _, err := conn.Write([]byte{userPassVersion, userPassSuccess}); err != nil {
+		return "", fmt.Errorf("failed to write auth status: %v", err)
+	}
+	return username, nil
+}
+
+func readLenString(conn io.Reader) (string, error) {
+	var l byte
+	if err := binary.Read(conn, ByteOrder, &l); err != nil {
+		return "", err
+	}
+	if l == 0 {
+		return "", errors.New("empty value")
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
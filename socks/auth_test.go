@@ -0,0 +1,130 @@
+package socks
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// fakeConn reads in and records what is written.
+func fakeConn(in []byte) (*readWriter, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	return &readWriter{Reader: bytes.NewReader(in), Writer: out}, out
+}
+
+func userPassRequest(ver byte, user, pass string) []byte {
+	msg := []byte{ver, byte(len(user))}
+	msg = append(msg, user...)
+	msg = append(msg, byte(len(pass)))
+	return append(msg, pass...)
+}
+
+func TestNegotiateUserPass(t *testing.T) {
+	check := StaticCredentials(map[string]string{"alice": "secret"})
+	tests := []struct {
+		name       string
+		in         []byte
+		wantUser   string
+		wantErr    bool
+		wantStatus []byte
+	}{
+		{"valid", userPassRequest(userPassVersion, "alice", "secret"), "alice", false, []byte{0x01, 0x00}},
+		{"wrong password", userPassRequest(userPassVersion, "alice", "nope"), "", true, []byte{0x01, 0x01}},
+		{"unknown user", userPassRequest(userPassVersion, "bob", "secret"), "", true, []byte{0x01, 0x01}},
+		{"password prefix", userPassRequest(userPassVersion, "alice", "secre"), "", true, []byte{0x01, 0x01}},
+		{"wrong version", userPassRequest(0x05, "alice", "secret"), "", true, nil},
+		{"empty username", userPassRequest(userPassVersion, "", "secret"), "", true, nil},
+		{"empty password", userPassRequest(userPassVersion, "alice", ""), "", true, nil},
+		{"truncated", userPassRequest(userPassVersion, "alice", "secret")[:8], "", true, nil},
+		{"long values", userPassRequest(userPassVersion, strings.Repeat("u", 255), strings.Repeat("p", 255)), "", true, []byte{0x01, 0x01}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, out := fakeConn(tt.in)
+			user, err := negotiateUserPass(conn, check)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if user != tt.wantUser {
+				t.Errorf("got user %q, want %q", user, tt.wantUser)
+			}
+			if !bytes.Equal(out.Bytes(), tt.wantStatus) {
+				t.Errorf("sent % x, want % x", out.Bytes(), tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestSocks5MethodSelection(t *testing.T) {
+	creds := StaticCredentials(map[string]string{"alice": "secret"})
+	connect := []byte{VerSocks5, CmdConnect, 0x00, ATypIPv4, 192, 0, 2, 1, 0, 80}
+	tests := []struct {
+		name        string
+		credentials CredentialChecker
+		in          []byte
+		wantMethod  byte
+		wantUser    string
+		wantErr     bool
+	}{
+		{"no auth", nil, append([]byte{VerSocks5, 1, MethodNoAuth}, connect...), MethodNoAuth, "", false},
+		{"auth required but not offered", creds, []byte{VerSocks5, 1, MethodNoAuth}, MethodNoAcceptable, "", true},
+		{"auth", creds, append(append([]byte{VerSocks5, 2, MethodNoAuth, MethodUserPass},
+			userPassRequest(userPassVersion, "alice", "secret")...), connect...), MethodUserPass, "alice", false},
+		{"bad credentials", creds, append([]byte{VerSocks5, 1, MethodUserPass},
+			userPassRequest(userPassVersion, "alice", "wrong")...), MethodUserPass, "", true},
+		{"only auth offered without credentials", nil, []byte{VerSocks5, 1, MethodUserPass}, MethodNoAcceptable, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, out := fakeConn(tt.in)
+			s5 := &Socks5{Credentials: tt.credentials}
+			req, err := s5.Negotiate(conn)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if sent := out.Bytes(); len(sent) < 2 || sent[0] != VerSocks5 || sent[1] != tt.wantMethod {
+				t.Errorf("sent % x, want method 0x%02x", sent, tt.wantMethod)
+			}
+			if err == nil && req.User != tt.wantUser {
+				t.Errorf("got user %q, want %q", req.User, tt.wantUser)
+			}
+		})
+	}
+}
+
+func TestSocks4UserIDs(t *testing.T) {
+	request := func(id string) []byte {
+		msg := []byte{VerSocks4, CmdConnect, 0, 80, 192, 0, 2, 1}
+		return append(append(msg, id...), 0)
+	}
+	tests := []struct {
+		name     string
+		allow    UserIDChecker
+		in       []byte
+		wantUser string
+		wantErr  bool
+	}{
+		{"no allowlist", nil, request("anyone"), "", false},
+		{"allowed", AllowUserIDs("alice", "bob"), request("bob"), "bob", false},
+		{"not allowed", AllowUserIDs("alice"), request("mallory"), "", true},
+		{"empty allowlist", AllowUserIDs(), request(""), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, out := fakeConn(tt.in)
+			req, err := (&Socks4A{AllowUserID: tt.allow}).Negotiate(conn)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if sent := out.Bytes(); len(sent) < 2 || sent[1] != CDRejectedOrFailed {
+					t.Errorf("sent % x, want a rejection", sent)
+				}
+				return
+			}
+			if req.User != tt.wantUser {
+				t.Errorf("got user %q, want %q", req.User, tt.wantUser)
+			}
+		})
+	}
+}
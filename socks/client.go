@@ -0,0 +1,411 @@
+package socks
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ReplyError is a request refused by an upstream proxy. SOCKS4 failures
+// are mapped to the closest SOCKS5 reply.
+type ReplyError struct {
+	Reply byte
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("proxy refused request: %s", ReplyText(e.Reply))
+}
+
+// Client makes requests through an upstream SOCKS proxy.
+type Client struct {
+	Address string
+	// Version is VerSocks4 or VerSocks5. SOCKS4 requests for domains are
+	// sent as SOCKS4a unless ResolveLocally is set.
+	Version        byte
+	ResolveLocally bool
+	// Username is sent as the SOCKS4 USERID. For SOCKS5 it and Password
+	// are used to log in with RFC 1929 if the proxy asks.
+	Username string
+	Password string
+	// Dialer connects to the proxy.
+	Dialer *net.Dialer
+	// HandshakeTimeout limits the negotiation with the proxy, without a
+	// limit if zero.
+	HandshakeTimeout time.Duration
+}
+
+func NewClient(address string, ver byte) *Client {
+	return &Client{
+		Address:          address,
+		Version:          ver,
+		Dialer:           &net.Dialer{},
+		HandshakeTimeout: DefaultHandshakeTimeout,
+	}
+}
+
+// Conn is a connection made through a proxy, along with the address the
+// proxy connected from.
+type Conn struct {
+	net.Conn
+	BindAddr Addr
+	BindPort uint16
+}
+
+func (c *Client) Dial(network, address string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address with a CONNECT request. Only tcp, tcp4
+// and tcp6 are supported.
+func (c *Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %s", network)
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to split address: %v", err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", portStr)
+	}
+	conn, res, err := c.request(ctx, &Request{
+		Cmd:      CmdConnect,
+		DestAddr: ParseAddr(host),
+		DestPort: uint16(port),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{
+		Conn:     conn,
+		BindAddr: res.BindAddr,
+		BindPort: res.BindPort,
+	}, nil
+}
+
+// ListenPacket opens a SOCKS5 UDP association, which lasts until the
+// returned PacketConn is closed or the proxy drops the association.
+// Fragmented datagrams from the proxy are dropped.
+func (c *Client) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	if c.Version != VerSocks5 {
+		return nil, errors.New("UDP ASSOCIATE needs SOCKS5")
+	}
+	ctrl, res, err := c.request(ctx, &Request{
+		Cmd:      CmdUdpAddociate,
+		DestAddr: AddrIPv4{},
+	})
+	if err != nil {
+		return nil, err
+	}
+	proxyIP := ctrl.RemoteAddr().(*net.TCPAddr).IP
+	relayIP := net.ParseIP(res.BindAddr.String())
+	if relayIP == nil || relayIP.IsUnspecified() {
+		relayIP = proxyIP
+	}
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{
+		IP: ctrl.LocalAddr().(*net.TCPAddr).IP,
+	})
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("failed to open UDP socket: %v", err)
+	}
+	a := &association{
+		ctrl:    ctrl,
+		UDPConn: pc,
+		relay:   &net.UDPAddr{IP: relayIP, Port: int(res.BindPort)},
+		buf:     make([]byte, 65535),
+	}
+	// The proxy ends the association by closing the control connection.
+	go func() {
+		io.Copy(ioutil.Discard, ctrl)
+		a.Close()
+	}()
+	return a, nil
+}
+
+// request connects to the proxy and sends req, returning the connection
+// once the proxy has replied.
+func (c *Client) request(ctx context.Context, req *Request) (net.Conn, *Response, error) {
+	dialer := c.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", c.Address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to proxy: %v", err)
+	}
+	if c.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.HandshakeTimeout))
+	}
+	res, err := c.Handshake(conn, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, res, nil
+}
+
+// Handshake sends req over a connection to the proxy and reads the reply.
+// A refused request returns a *ReplyError.
+func (c *Client) Handshake(conn io.ReadWriter, req *Request) (*Response, error) {
+	switch c.Version {
+	case VerSocks4:
+		return c.handshake4(conn, req)
+	case VerSocks5:
+		return c.handshake5(conn, req)
+	}
+	return nil, fmt.Errorf("unsupported SOCKS version 0x%02x", c.Version)
+}
+
+func (c *Client) handshake4(conn io.ReadWriter, req *Request) (*Response, error) {
+	if req.Cmd != CmdConnect && req.Cmd != CmdBind {
+		return nil, fmt.Errorf("SOCKS4 doesn't support CMD 0x%02x", req.Cmd)
+	}
+	var (
+		ip     AddrIPv4
+		domain []byte
+		err    error
+	)
+	switch addr := req.DestAddr.(type) {
+	case AddrIPv4:
+		ip = addr
+	case AddrDomain:
+		if c.ResolveLocally {
+			if ip, err = addr.ToIPv4(); err != nil {
+				return nil, err
+			}
+		} else {
+			// SOCKS4a: an invalid IP of 0.0.0.x tells the proxy to look
+			// up the domain following the USERID.
+			ip = AddrIPv4{0, 0, 0, 1}
+			domain = addr
+		}
+	default:
+		return nil, errors.New("SOCKS4 only supports IPv4 addresses")
+	}
+	msg := []byte{VerSocks4, req.Cmd}
+	msg = binary.BigEndian.AppendUint16(msg, req.DestPort)
+	msg = append(msg, ip[:]...)
+	msg = append(append(msg, c.Username...), 0)
+	if domain != nil {
+		msg = append(append(msg, domain...), 0)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, fmt.Errorf("failed to read reply: %v", err)
+	}
+	switch reply[1] {
+	case CDGranted:
+	case CDCannotConnectIdend, CDDifferentUserIds:
+		return nil, &ReplyError{Reply: RepConnectionNotAllowedByRuleset}
+	default:
+		return nil, &ReplyError{Reply: RepGeneralSocksServerFailure}
+	}
+	res := &Response{
+		Reply:    RepSucceeded,
+		BindPort: ByteOrder.Uint16(reply[2:4]),
+	}
+	res.BindAddr, _ = DecodeIPv4(reply[4:8])
+	return res, nil
+}
+
+func (c *Client) handshake5(conn io.ReadWriter, req *Request) (*Response, error) {
+	methods := []byte{MethodNoAuth}
+	if c.Username != "" {
+		methods = append(methods, MethodUserPass)
+	}
+	if _, err := conn.Write(append(
+		[]byte{VerSocks5, byte(len(methods))},
+		methods...,
+	)); err != nil {
+		return nil, fmt.Errorf("failed to send methods: %v", err)
+	}
+	chosen := make([]byte, 2)
+	if _, err := io.ReadFull(conn, chosen); err != nil {
+		return nil, fmt.Errorf("failed to read method: %v", err)
+	}
+	if chosen[0] != VerSocks5 {
+		return nil, fmt.Errorf("incorrect VER, expected 0x05, received 0x%02x", chosen[0])
+	}
+	switch chosen[1] {
+	case MethodNoAuth:
+	case MethodUserPass:
+		if c.Username == "" {
+			return nil, errors.New("proxy chose a method we didn't offer")
+		}
+		if err := c.sendUserPass(conn); err != nil {
+			return nil, fmt.Errorf("failed to authenticate: %v", err)
+		}
+	case MethodNoAcceptable:
+		return nil, errors.New("proxy accepted none of our methods")
+	default:
+		return nil, fmt.Errorf("proxy chose unknown method 0x%02x", chosen[1])
+	}
+
+	msg := []byte{VerSocks5, req.Cmd, 0x00, req.DestAddr.Type()}
+	raw := req.DestAddr.Encode()
+	if req.DestAddr.Type() == ATypDomain {
+		msg = append(msg, byte(len(raw)))
+	}
+	msg = append(msg, raw...)
+	msg = binary.BigEndian.AppendUint16(msg, req.DestPort)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	// VER REP RSV ATYP
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, fmt.Errorf("failed to read reply: %v", err)
+	}
+	if header[0] != VerSocks5 {
+		return nil, fmt.Errorf("incorrect VER, expected 0x05, received 0x%02x", header[0])
+	}
+	if header[1] != RepSucceeded {
+		return nil, &ReplyError{Reply: header[1]}
+	}
+	res := &Response{Reply: RepSucceeded}
+	var err error
+	if res.BindAddr, err = readAddr(conn, header[3]); err != nil {
+		return nil, fmt.Errorf("failed to read BND.ADDR: %v", err)
+	}
+	if err := binary.Read(conn, ByteOrder, &res.BindPort); err != nil {
+		return nil, fmt.Errorf("failed to read BND.PORT: %v", err)
+	}
+	return res, nil
+}
+
+// sendUserPass runs the client side of the RFC 1929 sub-negotiation.
+func (c *Client) sendUserPass(conn io.ReadWriter) error {
+	if len(c.Username) > 255 || len(c.Password) > 255 {
+		return errors.New("username and password must be at most 255 bytes")
+	}
+	msg := []byte{userPassVersion, byte(len(c.Username))}
+	msg = append(msg, c.Username...)
+	msg = append(msg, byte(len(c.Password)))
+	msg = append(msg, c.Password...)
+	if _, err := conn.Write(msg); err != nil {
+		return fmt.Errorf("failed to send credentials: %v", err)
+	}
+	status := make([]byte, 2)
+	if _, err := io.ReadFull(conn, status); err != nil {
+		return fmt.Errorf("failed to read auth status: %v", err)
+	}
+	if status[0] != userPassVersion {
+		return fmt.Errorf("incorrect auth VER, expected 0x%02x, received 0x%02x", userPassVersion, status[0])
+	}
+	if status[1] != userPassSuccess {
+		return errors.New("proxy rejected credentials")
+	}
+	return nil
+}
+
+func readAddr(r io.Reader, typ byte) (Addr, error) {
+	var n int
+	switch typ {
+	case ATypIPv4:
+		n = 4
+	case ATypIPv6:
+		n = 16
+	case ATypDomain:
+		var l byte
+		if err := binary.Read(r, ByteOrder, &l); err != nil {
+			return nil, err
+		}
+		n = int(l)
+	default:
+		return nil, fmt.Errorf("unknown address type 0x%x", typ)
+	}
+	raw := make([]byte, n)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+	return Decode(typ, raw)
+}
+
+// association is a UDP socket which sends and receives datagrams through a
+// proxy's UDP relay.
+type association struct {
+	*net.UDPConn
+	ctrl  net.Conn
+	relay *net.UDPAddr
+	// readMu guards buf, which datagrams are read into before being
+	// unwrapped into the caller's buffer.
+	readMu sync.Mutex
+	buf    []byte
+}
+
+func (a *association) ReadFrom(p []byte) (int, net.Addr, error) {
+	a.readMu.Lock()
+	defer a.readMu.Unlock()
+	buf := a.buf
+	for {
+		n, src, err := a.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !src.IP.Equal(a.relay.IP) || src.Port != a.relay.Port {
+			continue
+		}
+		d, err := ParseDatagram(buf[:n])
+		if err != nil || d.Frag != 0 {
+			continue
+		}
+		port := strconv.Itoa(int(d.DestPort))
+		var addr net.Addr
+		if ip := net.ParseIP(d.DestAddr.String()); ip != nil {
+			addr = &net.UDPAddr{IP: ip, Port: int(d.DestPort)}
+		} else {
+			addr = udpHostAddr(net.JoinHostPort(d.DestAddr.String(), port))
+		}
+		return copy(p, d.Data), addr, nil
+	}
+}
+
+// WriteTo sends p to addr, which may be a host name for the proxy to look
+// up.
+func (a *association) WriteTo(p []byte, addr net.Addr) (int, error) {
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0, fmt.Errorf("failed to split address: %v", err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %s", portStr)
+	}
+	d := &Datagram{
+		DestAddr: ParseAddr(host),
+		DestPort: uint16(port),
+		Data:     p,
+	}
+	if _, err := a.WriteToUDP(d.Encode(), a.relay); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (a *association) Close() error {
+	a.ctrl.Close()
+	return a.UDPConn.Close()
+}
+
+// udpHostAddr is the address of a datagram from a host name.
+type udpHostAddr string
+
+func (a udpHostAddr) Network() string { return "udp" }
+func (a udpHostAddr) String() string  { return string(a) }
@@ -0,0 +1,133 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// refusedPort is a destination port the test server refuses connections to.
+const refusedPort = 81
+
+// startServer serves ver on loopback, replying to every request and sending
+// it to the returned channel.
+func startServer(t *testing.T, ver Version) (string, <-chan *Request) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	reqs := make(chan *Request, 1)
+	s := NewServer(ver, ln, func(ver Version, conn io.ReadWriter, req *Request) error {
+		reqs <- req
+		res := &Response{BindAddr: AddrIPv4{192, 0, 2, 1}, BindPort: 1080}
+		if req.DestPort == refusedPort {
+			res = &Response{Reply: RepConnectionRefused}
+		}
+		return ver.SendResponseHeader(conn, req, res)
+	})
+	go s.Serve(context.Background())
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	return ln.Addr().String(), reqs
+}
+
+func TestClientDial(t *testing.T) {
+	ver := &Socks45{
+		Socks4A: Socks4A{AllowUserID: AllowUserIDs("alice")},
+		Socks5: Socks5{
+			Credentials: StaticCredentials(map[string]string{"alice": "secret"}),
+		},
+	}
+	tests := []struct {
+		name           string
+		version        byte
+		resolveLocally bool
+		username       string
+		password       string
+		address        string
+		wantDest       string
+		wantUser       string
+		wantReply      byte
+		wantErr        bool
+	}{
+		{"socks4", VerSocks4, false, "alice", "", "127.0.0.1:80", "127.0.0.1", "alice", 0, false},
+		{"socks4a", VerSocks4, false, "alice", "", "example.com:80", "example.com", "alice", 0, false},
+		{"socks4 resolve locally", VerSocks4, true, "alice", "", "localhost:80", "127.0.0.1", "alice", 0, false},
+		{"socks4 userid refused", VerSocks4, false, "bob", "", "127.0.0.1:80", "", "", RepGeneralSocksServerFailure, true},
+		{"socks4 refused", VerSocks4, false, "alice", "", "127.0.0.1:81", "", "", RepGeneralSocksServerFailure, true},
+		{"socks5 ipv4", VerSocks5, false, "alice", "secret", "127.0.0.1:80", "127.0.0.1", "alice", 0, false},
+		{"socks5 ipv6", VerSocks5, false, "alice", "secret", "[2001:db8::1]:80", "2001:db8::1", "alice", 0, false},
+		{"socks5 domain", VerSocks5, false, "alice", "secret", "example.com:80", "example.com", "alice", 0, false},
+		{"socks5 wrong password", VerSocks5, false, "alice", "wrong", "127.0.0.1:80", "", "", 0, true},
+		{"socks5 no credentials", VerSocks5, false, "", "", "127.0.0.1:80", "", "", 0, true},
+		{"socks5 refused", VerSocks5, false, "alice", "secret", "127.0.0.1:81", "", "", RepConnectionRefused, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address, reqs := startServer(t, ver)
+			c := NewClient(address, tt.version)
+			c.ResolveLocally = tt.resolveLocally
+			c.Username = tt.username
+			c.Password = tt.password
+			conn, err := c.Dial("tcp", tt.address)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantReply != 0 {
+				var replyErr *ReplyError
+				if !errors.As(err, &replyErr) || replyErr.Reply != tt.wantReply {
+					t.Fatalf("got error %v, want reply 0x%02x", err, tt.wantReply)
+				}
+			}
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			req := <-reqs
+			if req.DestAddr.String() != tt.wantDest {
+				t.Errorf("server got destination %s, want %s", req.DestAddr, tt.wantDest)
+			}
+			if req.User != tt.wantUser {
+				t.Errorf("server got user %q, want %q", req.User, tt.wantUser)
+			}
+			sc := conn.(*Conn)
+			if sc.BindAddr.String() != "192.0.2.1" || sc.BindPort != 1080 {
+				t.Errorf("got bind address %s:%d, want 192.0.2.1:1080", sc.BindAddr, sc.BindPort)
+			}
+		})
+	}
+}
+
+func TestClientUserPassStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  []byte
+		wantErr bool
+	}{
+		{"success", []byte{userPassVersion, userPassSuccess}, false},
+		{"failure", []byte{userPassVersion, userPassFailure}, true},
+		{"wrong version", []byte{VerSocks5, userPassSuccess}, true},
+		{"truncated", []byte{userPassVersion}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, out := fakeConn(tt.status)
+			c := &Client{Username: "alice", Password: "secret"}
+			err := c.sendUserPass(conn)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			want := userPassRequest(userPassVersion, "alice", "secret")
+			if out.String() != string(want) {
+				t.Errorf("sent % x, want % x", out.Bytes(), want)
+			}
+		})
+	}
+}
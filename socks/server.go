@@ -0,0 +1,161 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/beefsack/go-under-cover/llog"
+	"github.com/beefsack/go-under-cover/metrics"
+)
+
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// ErrServerClosed is returned by Serve once Shutdown has been called.
+var ErrServerClosed = errors.New("socks: server closed")
+
+// Server serves SOCKS requests from a listener, tracking active connections
+// so it can be shut down without cutting them off.
+type Server struct {
+	Version  Version
+	Listener net.Listener
+	Handler  Handler
+	// HandshakeTimeout limits how long a client has to send its request,
+	// without a limit if zero.
+	HandshakeTimeout time.Duration
+
+	nextID uint64
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func NewServer(ver Version, listener net.Listener, handler Handler) *Server {
+	return &Server{
+		Version:          ver,
+		Listener:         listener,
+		Handler:          handler,
+		HandshakeTimeout: DefaultHandshakeTimeout,
+		conns:            map[net.Conn]bool{},
+	}
+}
+
+// Serve accepts connections until ctx is done or Shutdown is called.
+// Connections already accepted are left to finish, use Shutdown to wait for
+// them.
+func (s *Server) Serve(ctx context.Context) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Listener.Close()
+		case <-stop:
+		}
+	}()
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				logger.Warn("failed to accept connection: %v", err)
+				continue
+			}
+			return err
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Shutdown stops accepting connections and waits for active ones to finish.
+// If ctx is done first the remaining connections are closed and its error
+// is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.Listener.Close()
+
+	idle := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		logger.Warn("closing %d SOCKS connections still active", len(s.conns))
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = true
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+	log := logger.With(
+		llog.F("conn", atomic.AddUint64(&s.nextID, 1)),
+		llog.F("remote", conn.RemoteAddr().String()),
+	)
+	log.Debug("connection from %s", conn.RemoteAddr())
+	start := time.Now()
+	if s.HandshakeTimeout > 0 {
+		conn.SetDeadline(start.Add(s.HandshakeTimeout))
+	}
+	req, err := s.Version.Negotiate(conn)
+	if err != nil {
+		log.Warn("failed to negotiate: %v", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	metrics.HandshakeSeconds.ObserveSince(start, "socks")
+	log = log.With(
+		llog.F("user", req.User),
+		llog.F("dest", net.JoinHostPort(req.DestAddr.String(), strconv.Itoa(int(req.DestPort)))),
+	)
+	req.Log = log
+	if err := s.Handler(s.Version, conn, req); err != nil {
+		log.Warn("failed to handle request: %v", err)
+	}
+}
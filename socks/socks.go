@@ -2,6 +2,7 @@ package socks
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -11,6 +12,8 @@ import (
 	"github.com/beefsack/go-under-cover/llog"
 )
 
+var logger = llog.Named("socks")
+
 const (
 	VerSocks4 byte = 0x04
 	VerSocks5 byte = 0x05
@@ -39,11 +42,47 @@ const (
 
 var ByteOrder = binary.BigEndian
 
+var replyText = map[byte]string{
+	RepSucceeded:                     "succeeded",
+	RepGeneralSocksServerFailure:     "general failure",
+	RepConnectionNotAllowedByRuleset: "not allowed by ruleset",
+	RepNetworkUnreachable:            "network unreachable",
+	RepHostUnreachable:               "host unreachable",
+	RepConnectionRefused:             "connection refused",
+	RepTTLExpired:                    "TTL expired",
+	RepCommandNotSupported:           "command not supported",
+	RepAddressTypeNotSupported:       "address type not supported",
+}
+
+// ReplyText describes a SOCKS5 reply code.
+func ReplyText(rep byte) string {
+	if text, ok := replyText[rep]; ok {
+		return text
+	}
+	return fmt.Sprintf("unknown reply 0x%02x", rep)
+}
+
 type Request struct {
 	Ver, ConnType, Cmd, Frag byte
 	DestAddr                 Addr
 	DestPort                 uint16
 	UserID                   []byte
+	// User is the identity the client authenticated as, if any.
+	User string
+	// Log is the logger for the connection the request came in on, set by
+	// Server so handlers log with its fields.
+	Log *llog.Logger
+}
+
+// VersionName is 4, 4a or 5, with 4a being SOCKS4 requests for a domain.
+func (r *Request) VersionName() string {
+	if r.Ver == VerSocks5 {
+		return "5"
+	}
+	if _, ok := r.DestAddr.(AddrDomain); ok {
+		return "4a"
+	}
+	return "4"
 }
 
 type Response struct {
@@ -62,7 +101,12 @@ type readWriter struct {
 	io.Writer
 }
 
-type Socks45 struct{}
+// Socks45 accepts both SOCKS4A and SOCKS5 requests, negotiating with the
+// configured version matching the first byte from the client.
+type Socks45 struct {
+	Socks4A Socks4A
+	Socks5  Socks5
+}
 
 func FindVersion(ver byte) (v Version, ok bool) {
 	ok = true
@@ -85,8 +129,13 @@ func (s45 *Socks45) Negotiate(conn io.ReadWriter) (*Request, error) {
 		return nil, fmt.Errorf("failed to get version byte: %v", err)
 	}
 
-	subVer, ok := FindVersion(v[0])
-	if !ok {
+	var subVer Version
+	switch v[0] {
+	case VerSocks4:
+		subVer = &s45.Socks4A
+	case VerSocks5:
+		subVer = &s45.Socks5
+	default:
 		return nil, errors.New("could not find version")
 	}
 	return subVer.Negotiate(rw)
@@ -109,22 +158,10 @@ func Listen(ver Version, listenAddr string, handler Handler) error {
 	if err != nil {
 		return err
 	}
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			llog.Warn("failed to accept connection: %v", err)
-		}
-		go func() {
-			defer conn.Close()
-			llog.Debug("connection from %s", conn.RemoteAddr())
-			req, err := ver.Negotiate(conn)
-			if err != nil {
-				llog.Warn("failed to negotiate: %v", err)
-				return
-			}
-			if err := handler(ver, conn, req); err != nil {
-				llog.Warn("failed to handle request: %v", err)
-			}
-		}()
-	}
+	return Serve(ver, listener, handler)
+}
+
+// Serve serves SOCKS requests from listener until it fails.
+func Serve(ver Version, listener net.Listener, handler Handler) error {
+	return NewServer(ver, listener, handler).Serve(context.Background())
 }
@@ -5,8 +5,6 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-
-	"github.com/beefsack/go-under-cover/llog"
 )
 
 const (
@@ -16,7 +14,14 @@ const (
 	CDDifferentUserIds   byte = 93
 )
 
-type Socks4A struct{}
+// maxNullTerminatedLen caps USERID and domain fields, which are otherwise
+// unbounded.
+const maxNullTerminatedLen = 255
+
+type Socks4A struct {
+	// AllowUserID, when set, rejects requests whose USERID it doesn't allow.
+	AllowUserID UserIDChecker
+}
 
 func (s4 *Socks4A) Negotiate(conn io.ReadWriter) (req *Request, err error) {
 	req = &Request{
@@ -34,7 +39,7 @@ func (s4 *Socks4A) Negotiate(conn io.ReadWriter) (req *Request, err error) {
 		err = fmt.Errorf("failed to read CMD octet: %v", err)
 		return
 	}
-	if req.Cmd != CmdConnect {
+	if req.Cmd != CmdConnect && req.Cmd != CmdBind {
 		rep = CDRejectedOrFailed
 	}
 
@@ -57,12 +62,19 @@ func (s4 *Socks4A) Negotiate(conn io.ReadWriter) (req *Request, err error) {
 		err = fmt.Errorf("failed to read USERID: %v", err)
 		return
 	}
+	if s4.AllowUserID != nil {
+		if s4.AllowUserID(string(req.UserID)) {
+			req.User = string(req.UserID)
+		} else {
+			rep = CDRejectedOrFailed
+		}
+	}
 
 	// Socks 4A: if we get a 0.0.0.X IP where X is non-zero, read null
 	// terminated string and do DNS.
-	llog.Trace("DestAddr we got was %s", req.DestAddr.String())
+	logger.Trace("DestAddr we got was %s", req.DestAddr.String())
 	if addr[0]+addr[1]+addr[2] == 0 && addr[3] != 0 {
-		llog.Trace("got domain")
+		logger.Trace("got domain")
 		var (
 			domain []byte
 		)
@@ -80,7 +92,7 @@ func (s4 *Socks4A) Negotiate(conn io.ReadWriter) (req *Request, err error) {
 		s4.SendResponseHeader(conn, req, &Response{
 			Reply: rep,
 		})
-		err = fmt.Errorf("request failed with CD 0x%d", rep)
+		err = fmt.Errorf("request failed with CD 0x%02x", rep)
 	}
 	return
 }
@@ -90,9 +102,15 @@ func (s4 *Socks4A) SendResponseHeader(
 	req *Request,
 	res *Response,
 ) error {
-	cd := res.Reply
-	if cd == RepSucceeded {
+	var cd byte
+	switch {
+	case res.Reply == RepSucceeded:
 		cd = CDGranted
+	case res.Reply >= CDGranted && res.Reply <= CDDifferentUserIds:
+		cd = res.Reply
+	default:
+		// SOCKS4 has no finer grained failure codes.
+		cd = CDRejectedOrFailed
 	}
 	destPort := res.BindPort
 	if destPort == 0 {
@@ -104,13 +122,16 @@ func (s4 *Socks4A) SendResponseHeader(
 	}
 	ip, err := addr.ToIPv4()
 	if err != nil {
-		return fmt.Errorf("failed to convert %s to IPv4: %v", addr.String(), err)
+		// The address is informational, so don't fail the whole request
+		// when it can't be represented.
+		logger.Trace("failed to convert %s to IPv4: %v", addr.String(), err)
+		ip = AddrIPv4{}
 	}
-	reply := append([]byte{
+	reply := []byte{
 		0x00, // This VER is the "reply version" and should be 0
 		cd,
-	})
-	llog.Trace("Sending 0x%d", cd)
+	}
+	logger.Trace("Sending 0x%02x", cd)
 	if _, err := conn.Write(reply); err != nil {
 		return fmt.Errorf("failed to send reply: %v", err)
 	}
@@ -129,22 +150,28 @@ func (s4 *Socks4A) readVerOctet(conn io.ReadWriter) error {
 		return fmt.Errorf("failed to read client VER octet: %v", err)
 	}
 	if ver != VerSocks4 {
-		return fmt.Errorf("incorrect VER, expected 0x04, received 0x%d", ver)
+		return fmt.Errorf("incorrect VER, expected 0x04, received 0x%02x", ver)
 	}
 	return nil
 }
 
 func (s4 *Socks4A) readUntilNull(conn io.ReadWriter) ([]byte, error) {
 	b := bytes.NewBuffer([]byte{})
+	p := make([]byte, 1)
 	for {
-		p := make([]byte, 1)
-		if _, err := conn.Read(p); err != nil {
+		if _, err := io.ReadFull(conn, p); err != nil {
 			return b.Bytes(),
 				fmt.Errorf("failed to read null terminated string: %v", err)
 		}
 		if p[0] == 0 {
 			break
 		}
+		if b.Len() >= maxNullTerminatedLen {
+			return b.Bytes(), fmt.Errorf(
+				"null terminated string longer than %d bytes",
+				maxNullTerminatedLen,
+			)
+		}
 		b.WriteByte(p[0])
 	}
 	return b.Bytes(), nil
@@ -2,12 +2,15 @@ package socks
 
 import (
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
 )
 
-type Socks5 struct{}
+type Socks5 struct {
+	// Credentials, when set, requires clients to authenticate with a
+	// username and password.
+	Credentials CredentialChecker
+}
 
 func (s5 *Socks5) Negotiate(conn io.ReadWriter) (req *Request, err error) {
 	req = &Request{
@@ -36,22 +39,32 @@ func (s5 *Socks5) Negotiate(conn io.ReadWriter) (req *Request, err error) {
 		err = fmt.Errorf("failed to read METHODS octets: %v", err)
 		return
 	}
+	method := MethodNoAuth
+	if s5.Credentials != nil {
+		method = MethodUserPass
+	}
 	found := false
 	for _, m := range clientMethods {
-		if m == 0x00 {
+		if m == method {
 			found = true
 			break
 		}
 	}
 	if !found {
-		conn.Write([]byte{0xFF})
-		err = errors.New("only x00 NO AUTHENTICATION REQUIRED is supported")
+		conn.Write([]byte{VerSocks5, MethodNoAcceptable})
+		err = fmt.Errorf("client doesn't support required method 0x%02x", method)
 		return
 	}
-	if _, err = conn.Write([]byte{0x05, 0x00}); err != nil {
+	if _, err = conn.Write([]byte{VerSocks5, method}); err != nil {
 		err = fmt.Errorf("failed to write method octets: %v", err)
 		return
 	}
+	if method == MethodUserPass {
+		if req.User, err = negotiateUserPass(conn, s5.Credentials); err != nil {
+			err = fmt.Errorf("failed to authenticate: %v", err)
+			return
+		}
+	}
 
 	// Make request
 	var (
@@ -66,7 +79,11 @@ func (s5 *Socks5) Negotiate(conn io.ReadWriter) (req *Request, err error) {
 		err = fmt.Errorf("failed to read CMD octet: %v", err)
 		return
 	}
-	if req.Cmd != CmdConnect {
+	switch req.Cmd {
+	case CmdConnect, CmdBind:
+	case CmdUdpAddociate:
+		req.ConnType = ConnUDP
+	default:
 		rep = RepCommandNotSupported
 	}
 
@@ -109,14 +126,21 @@ func (s5 *Socks5) Negotiate(conn io.ReadWriter) (req *Request, err error) {
 	case ATypIPv6:
 		addr := make([]byte, 16)
 		if err = binary.Read(conn, ByteOrder, &addr); err != nil {
-			err = fmt.Errorf("failed to read IPv4 DST.ADDR: %v", err)
+			err = fmt.Errorf("failed to read IPv6 DST.ADDR: %v", err)
+			return
 		}
 		if req.DestAddr, err = DecodeIPv6(addr); err != nil {
 			err = fmt.Errorf("failed to parse IPv6 DST.ADDR: %v", err)
 			return
 		}
 	default:
-		rep = RepAddressTypeNotSupported
+		// The length of the address is unknown, so DST.PORT can't be
+		// read either.
+		s5.SendResponseHeader(conn, req, &Response{
+			Reply: RepAddressTypeNotSupported,
+		})
+		err = fmt.Errorf("unsupported ATYP 0x%02x", addrType)
+		return
 	}
 
 	if err = binary.Read(conn, ByteOrder, &req.DestPort); err != nil {
@@ -125,7 +149,7 @@ func (s5 *Socks5) Negotiate(conn io.ReadWriter) (req *Request, err error) {
 		s5.SendResponseHeader(conn, req, &Response{
 			Reply: rep,
 		})
-		err = fmt.Errorf("request failed with REP 0x%d", rep)
+		err = fmt.Errorf("request failed with REP 0x%02x", rep)
 	}
 	return
 }
@@ -139,6 +163,9 @@ func (s5 *Socks5) SendResponseHeader(
 	if bindAddr == nil {
 		bindAddr = req.DestAddr
 	}
+	if bindAddr == nil {
+		bindAddr = AddrIPv4{}
+	}
 	var encoded []byte
 	switch bindAddr.Type() {
 	case ATypDomain:
@@ -172,7 +199,7 @@ func (s5 *Socks5) readVerOctet(conn io.ReadWriter) error {
 		return fmt.Errorf("failed to read client VER octet: %v", err)
 	}
 	if ver != VerSocks5 {
-		return fmt.Errorf("incorrect VER, expected 0x04, received 0x%d", ver)
+		return fmt.Errorf("incorrect VER, expected 0x05, received 0x%02x", ver)
 	}
 	return nil
 }
@@ -0,0 +1,68 @@
+package socks
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSocks5Request(t *testing.T) {
+	request := func(cmd, atyp byte, addr ...byte) []byte {
+		msg := []byte{VerSocks5, 1, MethodNoAuth, VerSocks5, cmd, 0x00, atyp}
+		return append(msg, addr...)
+	}
+	methodReply := []byte{VerSocks5, MethodNoAuth}
+	tests := []struct {
+		name      string
+		in        []byte
+		wantDest  string
+		wantPort  uint16
+		wantErr   bool
+		wantReply []byte
+	}{
+		{"ipv4", request(CmdConnect, ATypIPv4, 192, 0, 2, 1, 0, 80), "192.0.2.1", 80, false, nil},
+		{"ipv6", request(CmdConnect, ATypIPv6, append(ParseAddr("2001:db8::1").Encode(), 1, 187)...),
+			"2001:db8::1", 443, false, nil},
+		{"domain", request(CmdConnect, ATypDomain, append([]byte{11}, "example.com\x00\x50"...)...),
+			"example.com", 80, false, nil},
+		{"unknown address type", request(CmdConnect, 0x09, 1, 2, 3, 4, 0, 80), "", 0, true,
+			[]byte{VerSocks5, RepAddressTypeNotSupported, 0x00, ATypIPv4, 0, 0, 0, 0, 0, 0}},
+		{"short ipv6", request(CmdConnect, ATypIPv6, 0x20, 0x01), "", 0, true, nil},
+		{"short ipv4", request(CmdConnect, ATypIPv4, 192, 0), "", 0, true, nil},
+		{"unsupported command", request(0x09, ATypIPv4, 192, 0, 2, 1, 0, 80), "", 0, true,
+			[]byte{VerSocks5, RepCommandNotSupported, 0x00, ATypIPv4, 192, 0, 2, 1, 0, 80}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, out := fakeConn(tt.in)
+			req, err := (&Socks5{}).Negotiate(conn)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if reply := bytes.TrimPrefix(out.Bytes(), methodReply); !bytes.Equal(reply, tt.wantReply) {
+				t.Errorf("sent % x, want % x", reply, tt.wantReply)
+			}
+			if err != nil {
+				return
+			}
+			if req.DestAddr.String() != tt.wantDest || req.DestPort != tt.wantPort {
+				t.Errorf("got %s port %d, want %s port %d", req.DestAddr, req.DestPort, tt.wantDest, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestSocks5ResponseWithoutAddress(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := (&Socks5{}).SendResponseHeader(
+		out,
+		&Request{Ver: VerSocks5},
+		&Response{Reply: RepGeneralSocksServerFailure},
+	)
+	if err != nil {
+		t.Fatalf("SendResponseHeader: %v", err)
+	}
+	want := []byte{VerSocks5, RepGeneralSocksServerFailure, 0x00, ATypIPv4, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("sent % x, want % x", out.Bytes(), want)
+	}
+}
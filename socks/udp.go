@@ -0,0 +1,126 @@
+package socks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultReassemblyTimeout is how long fragments of a datagram are kept
+// waiting for the rest, as suggested by RFC 1928.
+const DefaultReassemblyTimeout = 5 * time.Second
+
+const fragEnd byte = 0x80
+
+// Datagram is a UDP packet with the SOCKS5 UDP request header, as sent
+// between a client and the UDP relay of an association.
+type Datagram struct {
+	Frag     byte
+	DestAddr Addr
+	DestPort uint16
+	Data     []byte
+}
+
+func ParseDatagram(in []byte) (*Datagram, error) {
+	// RSV (2) FRAG (1) ATYP (1)
+	if len(in) < 4 {
+		return nil, errors.New("datagram too short for header")
+	}
+	d := &Datagram{Frag: in[2]}
+	typ := in[3]
+	rest := in[4:]
+	var addrLen int
+	switch typ {
+	case ATypIPv4:
+		addrLen = 4
+	case ATypIPv6:
+		addrLen = 16
+	case ATypDomain:
+		if len(rest) < 1 {
+			return nil, errors.New("datagram too short for domain length")
+		}
+		addrLen = int(rest[0])
+		rest = rest[1:]
+	default:
+		return nil, fmt.Errorf("unknown address type 0x%x", typ)
+	}
+	if len(rest) < addrLen+2 {
+		return nil, errors.New("datagram too short for DST.ADDR and DST.PORT")
+	}
+	var err error
+	raw := append([]byte(nil), rest[:addrLen]...)
+	if d.DestAddr, err = Decode(typ, raw); err != nil {
+		return nil, fmt.Errorf("failed to decode DST.ADDR: %v", err)
+	}
+	d.DestPort = ByteOrder.Uint16(rest[addrLen : addrLen+2])
+	d.Data = rest[addrLen+2:]
+	return d, nil
+}
+
+func (d *Datagram) Encode() []byte {
+	buf := bytes.NewBuffer([]byte{
+		0x00, 0x00, // RSV
+		d.Frag,
+		d.DestAddr.Type(),
+	})
+	raw := d.DestAddr.Encode()
+	if d.DestAddr.Type() == ATypDomain {
+		buf.WriteByte(byte(len(raw)))
+	}
+	buf.Write(raw)
+	binary.Write(buf, ByteOrder, d.DestPort)
+	buf.Write(d.Data)
+	return buf.Bytes()
+}
+
+// Reassembler joins fragmented datagrams back together. Fragments must
+// arrive in order, a fragment with a lower position than the last starts a
+// new datagram, and incomplete datagrams are dropped after Timeout.
+type Reassembler struct {
+	Timeout time.Duration
+
+	queue   []*Datagram
+	last    byte
+	expires time.Time
+}
+
+func NewReassembler() *Reassembler {
+	return &Reassembler{
+		Timeout: DefaultReassemblyTimeout,
+	}
+}
+
+// Add returns the complete datagram once d finishes one, otherwise nil.
+func (r *Reassembler) Add(d *Datagram, now time.Time) *Datagram {
+	if d.Frag == 0 {
+		r.queue = nil
+		return d
+	}
+	pos := d.Frag &^ fragEnd
+	if len(r.queue) > 0 && (pos <= r.last || now.After(r.expires)) {
+		r.queue = nil
+	}
+	if len(r.queue) == 0 {
+		r.expires = now.Add(r.Timeout)
+	}
+	// Fragments are usually parsed from a reused read buffer, so keep a copy.
+	frag := *d
+	frag.Data = append([]byte(nil), d.Data...)
+	r.queue = append(r.queue, &frag)
+	r.last = pos
+	if d.Frag&fragEnd == 0 {
+		return nil
+	}
+
+	whole := &Datagram{
+		DestAddr: r.queue[0].DestAddr,
+		DestPort: r.queue[0].DestPort,
+	}
+	for _, frag := range r.queue {
+		whole.Data = append(whole.Data, frag.Data...)
+	}
+	r.queue = nil
+	return whole
+}
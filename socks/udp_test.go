@@ -0,0 +1,133 @@
+package socks
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestDatagramRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		d    *Datagram
+	}{
+		{"ipv4", &Datagram{DestAddr: AddrIPv4{192, 0, 2, 1}, DestPort: 53, Data: []byte("query")}},
+		{"ipv6", &Datagram{DestAddr: ParseAddr("2001:db8::1"), DestPort: 443, Data: []byte{0, 1, 2}}},
+		{"domain", &Datagram{DestAddr: AddrDomain("example.com"), DestPort: 8080, Data: []byte("x")}},
+		{"fragment", &Datagram{Frag: 0x81, DestAddr: AddrIPv4{10, 0, 0, 1}, DestPort: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseDatagram(tt.d.Encode())
+			if err != nil {
+				t.Fatalf("ParseDatagram: %v", err)
+			}
+			if got.Frag != tt.d.Frag ||
+				got.DestAddr.String() != tt.d.DestAddr.String() ||
+				got.DestPort != tt.d.DestPort ||
+				!bytes.Equal(got.Data, tt.d.Data) {
+				t.Errorf("got %+v, want %+v", got, tt.d)
+			}
+		})
+	}
+}
+
+func TestParseDatagramErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"empty", nil},
+		{"short header", []byte{0, 0, 0}},
+		{"unknown type", []byte{0, 0, 0, 0x09, 1, 2, 3, 4, 0, 80}},
+		{"short ipv4", []byte{0, 0, 0, ATypIPv4, 1, 2, 3, 4, 0}},
+		{"short ipv6", []byte{0, 0, 0, ATypIPv6, 1, 2, 3, 4, 0, 80}},
+		{"missing domain length", []byte{0, 0, 0, ATypDomain}},
+		{"short domain", []byte{0, 0, 0, ATypDomain, 5, 'a', 'b', 0, 80}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseDatagram(tt.in); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestReassembler(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	frag := func(pos byte, data string) *Datagram {
+		return &Datagram{Frag: pos, DestAddr: AddrIPv4{192, 0, 2, 1}, DestPort: 53, Data: []byte(data)}
+	}
+	type step struct {
+		d    *Datagram
+		at   time.Duration
+		want string // empty if nothing should be returned
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"unfragmented", []step{
+			{frag(0, "whole"), 0, "whole"},
+		}},
+		{"in order", []step{
+			{frag(1, "ab"), 0, ""},
+			{frag(2, "cd"), 0, ""},
+			{frag(3|fragEnd, "ef"), 0, "abcdef"},
+		}},
+		{"single final fragment", []step{
+			{frag(1|fragEnd, "only"), 0, "only"},
+		}},
+		{"lower position restarts", []step{
+			{frag(1, "old"), 0, ""},
+			{frag(2, "old"), 0, ""},
+			{frag(1, "new"), 0, ""},
+			{frag(2|fragEnd, "er"), 0, "newer"},
+		}},
+		{"unfragmented discards queue", []step{
+			{frag(1, "lost"), 0, ""},
+			{frag(0, "plain"), 0, "plain"},
+			{frag(2|fragEnd, "end"), 0, "end"},
+		}},
+		{"timed out", []step{
+			{frag(1, "stale"), 0, ""},
+			{frag(2|fragEnd, "end"), 6 * time.Second, "end"},
+		}},
+		{"within timeout", []step{
+			{frag(1, "a"), 0, ""},
+			{frag(2|fragEnd, "b"), 4 * time.Second, "ab"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReassembler()
+			for i, s := range tt.steps {
+				got := r.Add(s.d, now.Add(s.at))
+				switch {
+				case s.want == "" && got != nil:
+					t.Fatalf("step %d returned %q early", i, got.Data)
+				case s.want != "" && got == nil:
+					t.Fatalf("step %d returned nothing, want %q", i, s.want)
+				case got != nil && string(got.Data) != s.want:
+					t.Fatalf("step %d returned %q, want %q", i, got.Data, s.want)
+				}
+				if got != nil && got.Frag != 0 {
+					t.Errorf("step %d returned FRAG 0x%02x", i, got.Frag)
+				}
+			}
+		})
+	}
+}
+
+func TestReassemblerCopiesFragments(t *testing.T) {
+	r := NewReassembler()
+	now := time.Now()
+	buf := []byte("first")
+	r.Add(&Datagram{Frag: 1, DestAddr: AddrIPv4{}, Data: buf}, now)
+	copy(buf, "XXXXX")
+	got := r.Add(&Datagram{Frag: 2 | fragEnd, DestAddr: AddrIPv4{}, Data: []byte("!")}, now)
+	if got == nil || string(got.Data) != "first!" {
+		t.Errorf("got %v, want first!", got)
+	}
+}
@@ -0,0 +1,126 @@
+package transport
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// authCookie carries the client's token in the WebSocket handshake so
+	// that it looks like any other session cookie.
+	authCookie = "session"
+
+	DefaultAuthWindow = 5 * time.Minute
+
+	nonceSize = 16
+)
+
+var (
+	ErrUnknownUser  = errors.New("unknown user")
+	ErrBadSignature = errors.New("bad signature")
+	ErrReplayed     = errors.New("token already used")
+)
+
+var b64 = base64.RawURLEncoding
+
+// NewToken creates a single use handshake token for user, signed with key.
+// The token is user, timestamp and a random nonce, followed by an
+// HMAC-SHA256 of them.
+func NewToken(user string, key []byte, now time.Time) (string, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	payload := strings.Join([]string{
+		b64.EncodeToString([]byte(user)),
+		strconv.FormatInt(now.Unix(), 10),
+		b64.EncodeToString(nonce),
+	}, ".")
+	return payload + "." + b64.EncodeToString(sign(key, payload)), nil
+}
+
+func sign(key []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// Verifier checks a handshake token, returning the user it was issued for.
+type Verifier interface {
+	Verify(token string, now time.Time) (string, error)
+}
+
+// Authenticator verifies handshake tokens against per-user keys. A single
+// pre-shared key is stored under the empty user name.
+type Authenticator struct {
+	Keys map[string][]byte
+	// Window is how far a token's timestamp may be from the server clock.
+	Window time.Duration
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func NewAuthenticator(keys map[string][]byte) *Authenticator {
+	return &Authenticator{
+		Keys:   keys,
+		Window: DefaultAuthWindow,
+	}
+}
+
+// Verify checks the token and returns the user it was issued for. Each token
+// is only accepted once within the window.
+func (a *Authenticator) Verify(token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return "", errors.New("malformed token")
+	}
+	rawUser, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return "", fmt.Errorf("malformed user: %v", err)
+	}
+	user := string(rawUser)
+	ts, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("malformed timestamp: %v", err)
+	}
+	sig, err := b64.DecodeString(parts[3])
+	if err != nil {
+		return "", fmt.Errorf("malformed signature: %v", err)
+	}
+	key, ok := a.Keys[user]
+	if !ok {
+		return "", ErrUnknownUser
+	}
+	if !hmac.Equal(sig, sign(key, strings.Join(parts[:3], "."))) {
+		return "", ErrBadSignature
+	}
+	issued := time.Unix(ts, 0)
+	if issued.Before(now.Add(-a.Window)) || issued.After(now.Add(a.Window)) {
+		return "", fmt.Errorf("token timestamp %s outside window", issued)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.seen == nil {
+		a.seen = map[string]time.Time{}
+	}
+	for n, expires := range a.seen {
+		if now.After(expires) {
+			delete(a.seen, n)
+		}
+	}
+	if _, ok := a.seen[parts[2]]; ok {
+		return "", ErrReplayed
+	}
+	a.seen[parts[2]] = issued.Add(a.Window)
+	return user, nil
+}
@@ -0,0 +1,88 @@
+package transport
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	keys := map[string][]byte{
+		"":      []byte("shared"),
+		"alice": []byte("alice key"),
+	}
+	token := func(user, key string, at time.Time) string {
+		tok, err := NewToken(user, []byte(key), at)
+		if err != nil {
+			t.Fatalf("NewToken: %v", err)
+		}
+		return tok
+	}
+	good := token("alice", "alice key", now)
+	parts := strings.Split(good, ".")
+	tests := []struct {
+		name     string
+		token    string
+		wantUser string
+		wantErr  error
+	}{
+		{"user", good, "alice", nil},
+		{"pre-shared key", token("", "shared", now), "", nil},
+		{"within window", token("alice", "alice key", now.Add(-4*time.Minute)), "alice", nil},
+		{"clock ahead", token("alice", "alice key", now.Add(4*time.Minute)), "alice", nil},
+		{"wrong key", token("alice", "shared", now), "", ErrBadSignature},
+		{"unknown user", token("bob", "alice key", now), "", ErrUnknownUser},
+		{"tampered user", b64.EncodeToString([]byte("")) + "." + strings.Join(parts[1:], "."), "", ErrBadSignature},
+		{"expired", token("alice", "alice key", now.Add(-6*time.Minute)), "", errAny},
+		{"future", token("alice", "alice key", now.Add(6*time.Minute)), "", errAny},
+		{"malformed", "not-a-token", "", errAny},
+		{"bad timestamp", parts[0] + ".x." + parts[2] + "." + parts[3], "", errAny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := NewAuthenticator(keys)
+			user, err := auth.Verify(tt.token, now)
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr == errAny && err == nil,
+				tt.wantErr != nil && tt.wantErr != errAny && !errors.Is(err, tt.wantErr):
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && user != tt.wantUser {
+				t.Errorf("got user %q, want %q", user, tt.wantUser)
+			}
+		})
+	}
+}
+
+var errAny = errors.New("any error")
+
+func TestVerifyReplay(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	auth := NewAuthenticator(map[string][]byte{"alice": []byte("key")})
+	tok, _ := NewToken("alice", []byte("key"), now)
+	other, _ := NewToken("alice", []byte("key"), now)
+	if _, err := auth.Verify(tok, now); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if _, err := auth.Verify(tok, now.Add(time.Minute)); err != ErrReplayed {
+		t.Errorf("second use returned %v, want ErrReplayed", err)
+	}
+	if _, err := auth.Verify(other, now); err != nil {
+		t.Errorf("another token was refused: %v", err)
+	}
+	// Once the window has passed the token is refused by its timestamp and
+	// forgotten.
+	later := now.Add(DefaultAuthWindow + time.Second)
+	if _, err := auth.Verify(tok, later); err == nil || err == ErrReplayed {
+		t.Errorf("expired token returned %v, want a timestamp error", err)
+	}
+	fresh, _ := NewToken("alice", []byte("key"), later)
+	auth.Verify(fresh, later)
+	if n := len(auth.seen); n != 1 {
+		t.Errorf("%d nonces remembered, want 1", n)
+	}
+}
@@ -0,0 +1,162 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/beefsack/go-under-cover/bridge"
+)
+
+// ErrDeadlineUnsupported is returned by NewDialer for transports whose
+// connections don't support deadlines, which net.Conns must.
+var ErrDeadlineUnsupported = errors.New("transport: deadlines not supported")
+
+// DeadlineTransport is a Transport which says whether the connections it
+// dials support deadlines.
+type DeadlineTransport interface {
+	SupportsDeadlines() bool
+}
+
+// SupportsDeadlines reports whether connections dialed through trans
+// support deadlines.
+func SupportsDeadlines(trans Transport) bool {
+	dt, ok := trans.(DeadlineTransport)
+	return ok && dt.SupportsDeadlines()
+}
+
+// Dialer dials TCP connections through a transport as net.Conns, so it can
+// be used as http.Transport.DialContext or as a proxy.ContextDialer from
+// golang.org/x/net/proxy.
+type Dialer struct {
+	Transport Transport
+}
+
+// NewDialer returns ErrDeadlineUnsupported if trans can't dial connections
+// with deadlines.
+func NewDialer(trans Transport) (*Dialer, error) {
+	if !SupportsDeadlines(trans) {
+		return nil, ErrDeadlineUnsupported
+	}
+	return &Dialer{Transport: trans}, nil
+}
+
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext gives up on the dial once ctx is done, closing the connection
+// if it turns up later. The transport is given ctx if it is a
+// ContextDialer, so it can stop at ctx's deadline itself. Only tcp, tcp4 and
+// tcp6 are supported.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{
+			Op:  "dial",
+			Net: network,
+			Err: net.UnknownNetworkError(network),
+		}
+	}
+	type dialed struct {
+		rwc io.ReadWriteCloser
+		err error
+	}
+	done := make(chan dialed, 1)
+	go func() {
+		rwc, err := DialContext(ctx, d.Transport, "tcp", address)
+		done <- dialed{rwc, err}
+	}()
+	select {
+	case res := <-done:
+		if res.err != nil {
+			return nil, res.err
+		}
+		return newConn(res.rwc, address)
+	case <-ctx.Done():
+		go func() {
+			if res := <-done; res.rwc != nil {
+				res.rwc.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func newConn(rwc io.ReadWriteCloser, address string) (net.Conn, error) {
+	if c, ok := rwc.(net.Conn); ok {
+		return c, nil
+	}
+	ds, ok := rwc.(deadlineStream)
+	if !ok {
+		rwc.Close()
+		return nil, ErrDeadlineUnsupported
+	}
+	host, port, _ := net.SplitHostPort(address)
+	return &streamConn{ds, newAddr("tcp", host, port)}, nil
+}
+
+type deadlineStream interface {
+	io.ReadWriteCloser
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// streamConn adapts a stream with deadlines which isn't a net.Conn.
+type streamConn struct {
+	deadlineStream
+	remote net.Addr
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	if s, ok := c.deadlineStream.(StatusConn); ok {
+		status := s.Status()
+		return newAddr("tcp", status.Host, strconv.Itoa(int(status.Port)))
+	}
+	return newAddr("tcp", "", "0")
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *streamConn) CloseWrite() error {
+	return bridge.CloseWrite(c.deadlineStream)
+}
+
+// Addr is the address of a destination given as a host name, which is only
+// resolved on the server.
+type Addr struct {
+	Net     string
+	Address string
+}
+
+func (a *Addr) Network() string {
+	return a.Net
+}
+
+func (a *Addr) String() string {
+	return a.Address
+}
+
+// newAddr returns a *net.TCPAddr or *net.UDPAddr for IP hosts, and an *Addr
+// for host names.
+func newAddr(network, host, port string) net.Addr {
+	p, _ := strconv.Atoi(port)
+	ip := net.ParseIP(host)
+	if ip == nil && host != "" {
+		if network != "udp" {
+			network = "tcp"
+		}
+		return &Addr{Net: network, Address: net.JoinHostPort(host, port)}
+	}
+	if network == "udp" {
+		return &net.UDPAddr{IP: ip, Port: p}
+	}
+	return &net.TCPAddr{IP: ip, Port: p}
+}
@@ -0,0 +1,94 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// plainTransport dials streams without deadlines.
+type plainTransport struct{}
+
+func (plainTransport) Dial(network, address string) (io.ReadWriteCloser, error) {
+	a, _ := net.Pipe()
+	return struct{ io.ReadWriteCloser }{a}, nil
+}
+
+func (plainTransport) Listen() (Listener, error) {
+	return nil, errors.New("can't listen")
+}
+
+// deadlineTransport records the deadline it was dialed with.
+type deadlineTransport struct {
+	plainTransport
+	deadline time.Time
+	ok       bool
+}
+
+func (t *deadlineTransport) SupportsDeadlines() bool {
+	return true
+}
+
+func (t *deadlineTransport) DialContext(ctx context.Context, network, address string) (io.ReadWriteCloser, error) {
+	t.deadline, t.ok = ctx.Deadline()
+	a, _ := net.Pipe()
+	return a, nil
+}
+
+func TestNewDialer(t *testing.T) {
+	tests := []struct {
+		name    string
+		trans   Transport
+		wantErr error
+	}{
+		{"no deadlines", plainTransport{}, ErrDeadlineUnsupported},
+		{"deadlines", &deadlineTransport{}, nil},
+		{"socks", NewSOCKS(nil), nil},
+		{"wss", NewWSSPlain("example.com:443"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewDialer(tt.trans); err != tt.wantErr {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDialContextDeadline(t *testing.T) {
+	trans := &deadlineTransport{}
+	d, err := NewDialer(trans)
+	if err != nil {
+		t.Fatalf("NewDialer: %v", err)
+	}
+	deadline := time.Now().Add(time.Minute)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	conn, err := d.DialContext(ctx, "tcp", "example.com:80")
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	conn.Close()
+	if !trans.ok || !trans.deadline.Equal(deadline) {
+		t.Errorf("transport dialed with deadline %v, %v, want %v", trans.deadline, trans.ok, deadline)
+	}
+}
+
+func TestDialContextNetworks(t *testing.T) {
+	d := &Dialer{Transport: &deadlineTransport{}}
+	for _, network := range []string{"udp", "unix", "ip"} {
+		if _, err := d.DialContext(context.Background(), network, "example.com:80"); err == nil {
+			t.Errorf("dialed %s", network)
+		}
+	}
+}
+
+func TestNewConnWithoutDeadlines(t *testing.T) {
+	rwc, _ := plainTransport{}.Dial("tcp", "example.com:80")
+	if _, err := newConn(rwc, "example.com:80"); err != ErrDeadlineUnsupported {
+		t.Errorf("got %v, want ErrDeadlineUnsupported", err)
+	}
+}
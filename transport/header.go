@@ -0,0 +1,50 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// The request header is the first thing sent on every tunnel stream, and
+// names where the server should connect the stream to. Each field is a
+// length prefixed string.
+func writeRequest(w io.Writer, network, host, port string) error {
+	buf := &bytes.Buffer{}
+	for _, s := range []string{network, host, port} {
+		if len(s) > 255 {
+			return fmt.Errorf("%s is too long", s)
+		}
+		buf.WriteByte(byte(len(s)))
+		buf.WriteString(s)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func readRequest(r io.Reader) (network, host, port string, err error) {
+	if network, err = readString(r); err != nil {
+		err = fmt.Errorf("failed to read network: %v", err)
+		return
+	}
+	if host, err = readString(r); err != nil {
+		err = fmt.Errorf("failed to read host: %v", err)
+		return
+	}
+	if port, err = readString(r); err != nil {
+		err = fmt.Errorf("failed to read port: %v", err)
+	}
+	return
+}
+
+func readString(r io.Reader) (string, error) {
+	l := make([]byte, 1)
+	if _, err := io.ReadFull(r, l); err != nil {
+		return "", err
+	}
+	s := make([]byte, l[0])
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
@@ -0,0 +1,67 @@
+package mux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	protoVersion byte = 0x01
+
+	cmdSYN  byte = 0x00 // open a stream
+	cmdFIN  byte = 0x01 // no more data from the sender on a stream
+	cmdPSH  byte = 0x02 // data for a stream
+	cmdRST  byte = 0x03 // abort a stream
+	cmdWND  byte = 0x04 // grant more send window on a stream
+	cmdPING byte = 0x05
+	cmdPONG byte = 0x06
+
+	headerSize = 8
+)
+
+var byteOrder = binary.BigEndian
+
+// header is VER | CMD | LENGTH (2) | STREAM ID (4)
+type header [headerSize]byte
+
+func (h header) version() byte {
+	return h[0]
+}
+
+func (h header) cmd() byte {
+	return h[1]
+}
+
+func (h header) length() uint16 {
+	return byteOrder.Uint16(h[2:4])
+}
+
+func (h header) streamID() uint32 {
+	return byteOrder.Uint32(h[4:8])
+}
+
+func encodeFrame(cmd byte, streamID uint32, payload []byte) []byte {
+	buf := make([]byte, headerSize+len(payload))
+	buf[0] = protoVersion
+	buf[1] = cmd
+	byteOrder.PutUint16(buf[2:4], uint16(len(payload)))
+	byteOrder.PutUint32(buf[4:8], streamID)
+	copy(buf[headerSize:], payload)
+	return buf
+}
+
+func readFrame(r io.Reader) (h header, payload []byte, err error) {
+	if _, err = io.ReadFull(r, h[:]); err != nil {
+		return
+	}
+	if h.version() != protoVersion {
+		err = fmt.Errorf("unsupported version 0x%x", h.version())
+		return
+	}
+	payload = make([]byte, h.length())
+	if _, err = io.ReadFull(r, payload); err != nil {
+		err = fmt.Errorf("failed to read payload: %v", err)
+	}
+	return
+}
@@ -0,0 +1,62 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		cmd      byte
+		streamID uint32
+		payload  []byte
+	}{
+		{"syn", cmdSYN, 1, nil},
+		{"psh", cmdPSH, 3, []byte("hello")},
+		{"wnd", cmdWND, 0xfffffffe, []byte{0, 0, 1, 0}},
+		{"max payload", cmdPSH, 2, bytes.Repeat([]byte{'x'}, 0xffff)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := encodeFrame(tt.cmd, tt.streamID, tt.payload)
+			h, payload, err := readFrame(bytes.NewReader(frame))
+			if err != nil {
+				t.Fatalf("readFrame: %v", err)
+			}
+			if h.cmd() != tt.cmd || h.streamID() != tt.streamID {
+				t.Errorf("got cmd 0x%x stream %d, want 0x%x stream %d",
+					h.cmd(), h.streamID(), tt.cmd, tt.streamID)
+			}
+			if int(h.length()) != len(tt.payload) || !bytes.Equal(payload, tt.payload) {
+				t.Errorf("payload mismatch, got %d bytes, want %d", len(payload), len(tt.payload))
+			}
+		})
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	good := encodeFrame(cmdPSH, 1, []byte("data"))
+	badVersion := append([]byte{}, good...)
+	badVersion[0] = 0x02
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"empty", nil},
+		{"short header", good[:headerSize-1]},
+		{"short payload", good[:len(good)-1]},
+		{"bad version", badVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := readFrame(bytes.NewReader(tt.input)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+	if _, _, err := readFrame(bytes.NewReader(nil)); err != io.EOF {
+		t.Errorf("empty input returned %v, want io.EOF", err)
+	}
+}
@@ -0,0 +1,339 @@
+// Package mux multiplexes many reliable streams over a single connection.
+package mux
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/beefsack/go-under-cover/llog"
+)
+
+var logger = llog.Named("transport")
+
+var (
+	ErrSessionClosed = errors.New("session closed")
+	ErrStreamReset   = errors.New("stream reset by peer")
+	ErrStreamClosed  = errors.New("stream closed")
+	ErrTimeout       = timeoutError{}
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type Config struct {
+	// KeepAliveInterval is how often a ping is sent to the peer.
+	KeepAliveInterval time.Duration
+	// KeepAliveTimeout is how long the session may go without receiving
+	// anything from the peer before it is closed.
+	KeepAliveTimeout time.Duration
+	// StreamWindow is the number of bytes each side may have in flight on a
+	// stream before the receiver grants more. It must match the peer's, as a
+	// stream sent more than this is reset.
+	StreamWindow uint32
+	// MaxFrameSize is the largest data payload sent in a single frame.
+	MaxFrameSize int
+	// AcceptBacklog is the number of opened streams which may wait for
+	// AcceptStream before further streams are reset.
+	AcceptBacklog int
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		KeepAliveInterval: 30 * time.Second,
+		KeepAliveTimeout:  90 * time.Second,
+		StreamWindow:      256 * 1024,
+		MaxFrameSize:      32 * 1024,
+		AcceptBacklog:     256,
+	}
+}
+
+type Session struct {
+	conn   io.ReadWriteCloser
+	config *Config
+
+	writeMu sync.Mutex
+
+	streamsMu sync.Mutex
+	streams   map[uint32]*Stream
+	nextID    uint32
+	draining  bool
+
+	accept   chan *Stream
+	lastRecv int64
+	// pongPending is set while a pong is being written, so pings arriving
+	// meanwhile are coalesced into it.
+	pongPending int32
+
+	die     chan struct{}
+	dieOnce sync.Once
+	dieErr  error
+}
+
+// Client starts a session on conn which opens odd numbered streams.
+func Client(conn io.ReadWriteCloser, config *Config) *Session {
+	return newSession(conn, config, 1)
+}
+
+// Server starts a session on conn which opens even numbered streams.
+func Server(conn io.ReadWriteCloser, config *Config) *Session {
+	return newSession(conn, config, 2)
+}
+
+func newSession(conn io.ReadWriteCloser, config *Config, firstID uint32) *Session {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	c := *config
+	config = &c
+	if config.MaxFrameSize <= 0 || config.MaxFrameSize > math.MaxUint16 {
+		config.MaxFrameSize = math.MaxUint16
+	}
+	s := &Session{
+		conn:     conn,
+		config:   config,
+		streams:  map[uint32]*Stream{},
+		nextID:   firstID,
+		accept:   make(chan *Stream, config.AcceptBacklog),
+		lastRecv: time.Now().UnixNano(),
+		die:      make(chan struct{}),
+	}
+	go s.recvLoop()
+	if config.KeepAliveInterval > 0 {
+		go s.keepAlive()
+	}
+	return s
+}
+
+func (s *Session) OpenStream() (*Stream, error) {
+	if s.IsClosed() {
+		return nil, ErrSessionClosed
+	}
+	s.streamsMu.Lock()
+	if s.draining {
+		s.streamsMu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	id := s.nextID
+	if id >= math.MaxUint32-1 {
+		s.streamsMu.Unlock()
+		return nil, errors.New("stream IDs exhausted")
+	}
+	s.nextID += 2
+	stream := newStream(id, s)
+	s.streams[id] = stream
+	s.streamsMu.Unlock()
+
+	if err := s.writeFrame(cmdSYN, id, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.die:
+		return nil, s.dieErr
+	}
+}
+
+func (s *Session) Close() error {
+	return s.closeWithErr(ErrSessionClosed)
+}
+
+// Drain stops new streams being opened, and closes the session once the
+// streams already open have ended.
+func (s *Session) Drain() {
+	s.streamsMu.Lock()
+	s.draining = true
+	idle := len(s.streams) == 0
+	s.streamsMu.Unlock()
+	if idle {
+		s.Close()
+	}
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseChan is closed when the session closes.
+func (s *Session) CloseChan() <-chan struct{} {
+	return s.die
+}
+
+func (s *Session) NumStreams() int {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	if c, ok := s.conn.(net.Conn); ok {
+		return c.LocalAddr()
+	}
+	return nil
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	if c, ok := s.conn.(net.Conn); ok {
+		return c.RemoteAddr()
+	}
+	return nil
+}
+
+func (s *Session) closeWithErr(err error) error {
+	var closeErr error
+	s.dieOnce.Do(func() {
+		s.dieErr = err
+		close(s.die)
+		closeErr = s.conn.Close()
+		s.streamsMu.Lock()
+		for id, stream := range s.streams {
+			stream.notify()
+			delete(s.streams, id)
+		}
+		s.streamsMu.Unlock()
+	})
+	return closeErr
+}
+
+func (s *Session) writeFrame(cmd byte, streamID uint32, payload []byte) error {
+	frame := encodeFrame(cmd, streamID, payload)
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.IsClosed() {
+		return ErrSessionClosed
+	}
+	if _, err := s.conn.Write(frame); err != nil {
+		s.closeWithErr(fmt.Errorf("failed to write frame: %v", err))
+		return err
+	}
+	return nil
+}
+
+func (s *Session) getStream(id uint32) *Stream {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.streamsMu.Lock()
+	delete(s.streams, id)
+	idle := s.draining && len(s.streams) == 0
+	s.streamsMu.Unlock()
+	if idle {
+		go s.Close()
+	}
+}
+
+func (s *Session) recvLoop() {
+	for {
+		h, payload, err := readFrame(s.conn)
+		if err != nil {
+			if err == io.EOF {
+				err = ErrSessionClosed
+			}
+			s.closeWithErr(err)
+			return
+		}
+		atomic.StoreInt64(&s.lastRecv, time.Now().UnixNano())
+
+		id := h.streamID()
+		switch h.cmd() {
+		case cmdSYN:
+			s.handleSYN(id)
+		case cmdPSH:
+			if stream := s.getStream(id); stream != nil {
+				stream.pushData(payload)
+			} else {
+				s.writeFrame(cmdRST, id, nil)
+			}
+		case cmdWND:
+			if len(payload) != 4 {
+				s.closeWithErr(errors.New("malformed window update"))
+				return
+			}
+			if stream := s.getStream(id); stream != nil {
+				stream.grantWindow(byteOrder.Uint32(payload))
+			}
+		case cmdFIN:
+			if stream := s.getStream(id); stream != nil {
+				stream.remoteFIN()
+			}
+		case cmdRST:
+			if stream := s.getStream(id); stream != nil {
+				stream.remoteRST()
+			}
+		case cmdPING:
+			if atomic.CompareAndSwapInt32(&s.pongPending, 0, 1) {
+				go func() {
+					s.writeFrame(cmdPONG, id, payload)
+					atomic.StoreInt32(&s.pongPending, 0)
+				}()
+			}
+		case cmdPONG:
+		default:
+			logger.Debug("ignoring unknown mux command 0x%x", h.cmd())
+		}
+	}
+}
+
+func (s *Session) handleSYN(id uint32) {
+	s.streamsMu.Lock()
+	if _, ok := s.streams[id]; ok || id%2 == s.nextID%2 {
+		s.streamsMu.Unlock()
+		s.writeFrame(cmdRST, id, nil)
+		return
+	}
+	stream := newStream(id, s)
+	s.streams[id] = stream
+	s.streamsMu.Unlock()
+
+	select {
+	case s.accept <- stream:
+	default:
+		logger.Warn("mux accept backlog full, resetting stream %d", id)
+		stream.Reset()
+	}
+}
+
+func (s *Session) keepAlive() {
+	ticker := time.NewTicker(s.config.KeepAliveInterval)
+	defer ticker.Stop()
+	var seq uint32
+	for {
+		select {
+		case <-s.die:
+			return
+		case now := <-ticker.C:
+			last := time.Unix(0, atomic.LoadInt64(&s.lastRecv))
+			if s.config.KeepAliveTimeout > 0 &&
+				now.Sub(last) > s.config.KeepAliveTimeout {
+				s.closeWithErr(errors.New("keepalive timeout"))
+				return
+			}
+			seq++
+			payload := make([]byte, 4)
+			byteOrder.PutUint32(payload, seq)
+			s.writeFrame(cmdPING, 0, payload)
+		}
+	}
+}
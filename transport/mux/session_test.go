@@ -0,0 +1,168 @@
+package mux
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func testConfig() *Config {
+	config := DefaultConfig()
+	config.KeepAliveInterval = 0
+	config.StreamWindow = 1024
+	config.MaxFrameSize = 256
+	return config
+}
+
+// pipeSessions runs a client and server session over net.Pipe.
+func pipeSessions(t *testing.T, config *Config) (*Session, *Session) {
+	t.Helper()
+	a, b := net.Pipe()
+	client := Client(a, config)
+	server := Server(b, config)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// openPair opens a stream from client and accepts it on server.
+func openPair(t *testing.T, client, server *Session) (*Stream, *Stream) {
+	t.Helper()
+	local, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	remote, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("AcceptStream: %v", err)
+	}
+	if local.ID() != remote.ID() {
+		t.Fatalf("stream IDs differ, %d and %d", local.ID(), remote.ID())
+	}
+	return local, remote
+}
+
+func waitClosed(t *testing.T, s *Session) {
+	t.Helper()
+	select {
+	case <-s.CloseChan():
+	case <-time.After(2 * time.Second):
+		t.Fatal("session didn't close")
+	}
+}
+
+func TestStreamIDs(t *testing.T) {
+	client, server := pipeSessions(t, testConfig())
+	tests := []struct {
+		name   string
+		open   *Session
+		accept *Session
+		want   uint32
+	}{
+		{"client first", client, server, 1},
+		{"client second", client, server, 3},
+		{"server first", server, client, 2},
+		{"server second", server, client, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local, remote := openPair(t, tt.open, tt.accept)
+			if local.ID() != tt.want || remote.ID() != tt.want {
+				t.Errorf("got stream %d, want %d", local.ID(), tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigNotModified(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxFrameSize int
+	}{
+		{"zero", 0},
+		{"negative", -1},
+		{"too large", 1 << 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.MaxFrameSize = tt.maxFrameSize
+			pipeSessions(t, config)
+			if config.MaxFrameSize != tt.maxFrameSize {
+				t.Errorf("MaxFrameSize changed to %d", config.MaxFrameSize)
+			}
+		})
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	client, server := pipeSessions(t, testConfig())
+	local, remote := openPair(t, client, server)
+	client.Close()
+	waitClosed(t, server)
+	if _, err := local.Write([]byte("x")); err == nil {
+		t.Error("write on closed session succeeded")
+	}
+	if _, err := remote.Read(make([]byte, 1)); err == nil {
+		t.Error("read on closed session succeeded")
+	}
+	if _, err := client.OpenStream(); err != ErrSessionClosed {
+		t.Errorf("OpenStream returned %v, want ErrSessionClosed", err)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	client, server := pipeSessions(t, testConfig())
+	local, remote := openPair(t, client, server)
+	client.Drain()
+	if _, err := client.OpenStream(); err != ErrSessionClosed {
+		t.Errorf("OpenStream while draining returned %v, want ErrSessionClosed", err)
+	}
+	if client.IsClosed() {
+		t.Fatal("session closed with a stream still open")
+	}
+	local.Close()
+	remote.Close()
+	waitClosed(t, client)
+}
+
+func TestDrainIdle(t *testing.T) {
+	client, _ := pipeSessions(t, testConfig())
+	client.Drain()
+	waitClosed(t, client)
+}
+
+func TestKeepAliveTimeout(t *testing.T) {
+	config := testConfig()
+	config.KeepAliveInterval = 10 * time.Millisecond
+	config.KeepAliveTimeout = 50 * time.Millisecond
+	a, b := net.Pipe()
+	defer b.Close()
+	// The peer reads pings but never answers.
+	go io.Copy(ioutil.Discard, b)
+	client := Client(a, config)
+	waitClosed(t, client)
+}
+
+func TestPingsCoalesced(t *testing.T) {
+	a, b := net.Pipe()
+	server := Server(a, testConfig())
+	defer server.Close()
+	defer b.Close()
+	before := runtime.NumGoroutine()
+	// The peer floods pings without reading any pongs.
+	payload := make([]byte, 4)
+	for i := 0; i < 100; i++ {
+		if _, err := b.Write(encodeFrame(cmdPING, 0, payload)); err != nil {
+			t.Fatalf("failed to write ping: %v", err)
+		}
+	}
+	if n := runtime.NumGoroutine() - before; n > 1 {
+		t.Errorf("%d goroutines started answering pings, want at most 1", n)
+	}
+}
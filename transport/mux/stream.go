@@ -0,0 +1,296 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stream is a single bidirectional stream within a Session. It implements
+// net.Conn, and CloseWrite half-closes the stream by sending FIN.
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	mu            sync.Mutex
+	recvBuf       bytes.Buffer
+	unacked       uint32
+	sendWindow    uint32
+	readDeadline  time.Time
+	writeDeadline time.Time
+	finRecv       bool
+	finSent       bool
+	closed        bool
+	reset         bool
+
+	recvNotify chan struct{}
+	sendNotify chan struct{}
+}
+
+func newStream(id uint32, sess *Session) *Stream {
+	return &Stream{
+		id:         id,
+		sess:       sess,
+		sendWindow: sess.config.StreamWindow,
+		recvNotify: make(chan struct{}, 1),
+		sendNotify: make(chan struct{}, 1),
+	}
+}
+
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.recvBuf.Len() > 0 {
+			n, _ := st.recvBuf.Read(p)
+			st.unacked += uint32(n)
+			var grant uint32
+			if st.unacked >= st.sess.config.StreamWindow/2 {
+				grant = st.unacked
+				st.unacked = 0
+			}
+			st.mu.Unlock()
+			if grant > 0 {
+				st.sendWindowUpdate(grant)
+			}
+			return n, nil
+		}
+		switch {
+		case st.reset:
+			st.mu.Unlock()
+			return 0, ErrStreamReset
+		case st.finRecv:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.closed:
+			st.mu.Unlock()
+			return 0, ErrStreamClosed
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := st.wait(st.recvNotify, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		st.mu.Lock()
+		switch {
+		case st.reset:
+			st.mu.Unlock()
+			return written, ErrStreamReset
+		case st.finSent || st.closed:
+			st.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := st.wait(st.sendNotify, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := len(p) - written
+		if n > st.sess.config.MaxFrameSize {
+			n = st.sess.config.MaxFrameSize
+		}
+		if uint32(n) > st.sendWindow {
+			n = int(st.sendWindow)
+		}
+		st.sendWindow -= uint32(n)
+		st.mu.Unlock()
+
+		if err := st.sess.writeFrame(cmdPSH, st.id, p[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite sends FIN to the peer, which will read EOF once it has
+// consumed everything already written.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.finSent || st.reset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.finSent = true
+	done := st.finRecv
+	st.mu.Unlock()
+
+	err := st.sess.writeFrame(cmdFIN, st.id, nil)
+	if done {
+		st.sess.removeStream(st.id)
+	}
+	return err
+}
+
+// Close half-closes the stream and discards anything the peer sends
+// afterwards. Data received but not read is granted back to the peer, so it
+// isn't left waiting for window.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	var grant uint32
+	if !st.reset {
+		grant = uint32(st.recvBuf.Len()) + st.unacked
+	}
+	st.recvBuf.Reset()
+	st.unacked = 0
+	st.mu.Unlock()
+	st.notify()
+	if grant > 0 {
+		st.sendWindowUpdate(grant)
+	}
+	return st.CloseWrite()
+}
+
+// Reset aborts the stream in both directions.
+func (st *Stream) Reset() error {
+	st.mu.Lock()
+	if st.reset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.reset = true
+	st.closed = true
+	st.recvBuf.Reset()
+	st.mu.Unlock()
+	st.notify()
+	st.sess.removeStream(st.id)
+	return st.sess.writeFrame(cmdRST, st.id, nil)
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.sess.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.sess.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.writeDeadline = t
+	st.mu.Unlock()
+	st.notify()
+	return nil
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	st.notify()
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	st.notify()
+	return nil
+}
+
+func (st *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return ErrTimeout
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return ErrTimeout
+	case <-st.sess.die:
+		return st.sess.dieErr
+	}
+}
+
+func (st *Stream) notify() {
+	for _, ch := range []chan struct{}{st.recvNotify, st.sendNotify} {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (st *Stream) pushData(data []byte) {
+	st.mu.Lock()
+	if st.closed || st.finRecv {
+		st.mu.Unlock()
+		if len(data) > 0 {
+			st.sendWindowUpdate(uint32(len(data)))
+		}
+		return
+	}
+	// Everything received which hasn't been granted back counts against
+	// the window, so a peer ignoring it can't grow recvBuf without limit.
+	if uint64(st.recvBuf.Len())+uint64(st.unacked)+uint64(len(data)) >
+		uint64(st.sess.config.StreamWindow) {
+		st.mu.Unlock()
+		logger.Warn("mux stream %d exceeded its receive window, resetting", st.id)
+		st.Reset()
+		return
+	}
+	st.recvBuf.Write(data)
+	st.mu.Unlock()
+	st.notify()
+}
+
+func (st *Stream) grantWindow(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.mu.Unlock()
+	st.notify()
+}
+
+func (st *Stream) remoteFIN() {
+	st.mu.Lock()
+	st.finRecv = true
+	done := st.finSent
+	st.mu.Unlock()
+	st.notify()
+	if done {
+		st.sess.removeStream(st.id)
+	}
+}
+
+func (st *Stream) remoteRST() {
+	st.mu.Lock()
+	st.reset = true
+	st.mu.Unlock()
+	st.notify()
+	st.sess.removeStream(st.id)
+}
+
+func (st *Stream) sendWindowUpdate(n uint32) {
+	payload := make([]byte, 4)
+	byteOrder.PutUint32(payload, n)
+	st.sess.writeFrame(cmdWND, st.id, payload)
+}
@@ -0,0 +1,176 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStreamTransfer(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"one frame", 100},
+		{"several frames", 1000},
+		// Larger than the window, so needs window updates to finish.
+		{"many windows", 64 * 1024},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := pipeSessions(t, testConfig())
+			local, remote := openPair(t, client, server)
+			data := bytes.Repeat([]byte("0123456789"), tt.size/10+1)[:tt.size]
+			errc := make(chan error, 1)
+			go func() {
+				_, err := local.Write(data)
+				if err == nil {
+					err = local.CloseWrite()
+				}
+				errc <- err
+			}()
+			got, err := io.ReadAll(remote)
+			if err != nil {
+				t.Fatalf("ReadAll: %v", err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("got %d bytes, want %d", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	client, server := pipeSessions(t, testConfig())
+	local, remote := openPair(t, client, server)
+	local.Write([]byte("request"))
+	local.CloseWrite()
+	got, err := io.ReadAll(remote)
+	if err != nil || string(got) != "request" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if _, err := local.Write([]byte("x")); err != ErrStreamClosed {
+		t.Errorf("write after CloseWrite returned %v, want ErrStreamClosed", err)
+	}
+	// The other direction stays open after FIN.
+	remote.Write([]byte("response"))
+	remote.CloseWrite()
+	got, err = io.ReadAll(local)
+	if err != nil || string(got) != "response" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	client, server := pipeSessions(t, testConfig())
+	local, remote := openPair(t, client, server)
+	local.Reset()
+	remote.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := remote.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Errorf("read after reset returned %v, want ErrStreamReset", err)
+	}
+	if _, err := remote.Write([]byte("x")); err != ErrStreamReset {
+		t.Errorf("write after reset returned %v, want ErrStreamReset", err)
+	}
+}
+
+func TestDeadlines(t *testing.T) {
+	client, server := pipeSessions(t, testConfig())
+	local, _ := openPair(t, client, server)
+	tests := []struct {
+		name string
+		set  func(time.Time) error
+		op   func() error
+	}{
+		{"read", local.SetReadDeadline, func() error {
+			_, err := local.Read(make([]byte, 1))
+			return err
+		}},
+		{"write", local.SetWriteDeadline, func() error {
+			// Nothing reads the remote end, so the window runs out.
+			_, err := local.Write(make([]byte, 4096))
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.set(time.Now().Add(20 * time.Millisecond))
+			err := tt.op()
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				t.Errorf("got %v, want a timeout", err)
+			}
+			tt.set(time.Time{})
+		})
+	}
+}
+
+func TestReceiveWindowEnforced(t *testing.T) {
+	a, b := net.Pipe()
+	server := Server(a, testConfig())
+	defer server.Close()
+	defer b.Close()
+	go func() {
+		b.Write(encodeFrame(cmdSYN, 1, nil))
+		// Ignore the window and keep sending.
+		chunk := make([]byte, 256)
+		for i := 0; i < 8; i++ {
+			if _, err := b.Write(encodeFrame(cmdPSH, 1, chunk)); err != nil {
+				return
+			}
+		}
+	}()
+	rst := make(chan struct{})
+	go func() {
+		var once sync.Once
+		for {
+			h, _, err := readFrame(b)
+			if err != nil {
+				return
+			}
+			if h.cmd() == cmdRST && h.streamID() == 1 {
+				once.Do(func() { close(rst) })
+			}
+		}
+	}()
+	stream, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("AcceptStream: %v", err)
+	}
+	select {
+	case <-rst:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream wasn't reset")
+	}
+	if _, err := stream.Read(make([]byte, 4096)); err != ErrStreamReset {
+		t.Errorf("read returned %v, want ErrStreamReset", err)
+	}
+}
+
+func TestCloseGrantsUnreadData(t *testing.T) {
+	client, server := pipeSessions(t, testConfig())
+	local, remote := openPair(t, client, server)
+	errc := make(chan error, 1)
+	go func() {
+		// Several windows, so the writer blocks until local closes.
+		_, err := remote.Write(make([]byte, 4096))
+		errc <- err
+	}()
+	// Let the writer fill the window before closing.
+	time.Sleep(50 * time.Millisecond)
+	local.Close()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Write returned %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Write blocked after the reader closed")
+	}
+}
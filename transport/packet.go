@@ -0,0 +1,52 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Streams dialed with the "udp" network carry datagrams rather than a byte
+// stream. Each datagram is framed with its length, then the host and port it
+// is being sent to, or was received from.
+func WritePacket(w io.Writer, host string, port uint16, data []byte) error {
+	if len(host) > 255 {
+		return fmt.Errorf("%s is too long", host)
+	}
+	size := 1 + len(host) + 2 + len(data)
+	if size > math.MaxUint16 {
+		return errors.New("packet too large")
+	}
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, uint16(size))
+	buf.WriteByte(byte(len(host)))
+	buf.WriteString(host)
+	binary.Write(buf, binary.BigEndian, port)
+	buf.Write(data)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func ReadPacket(r io.Reader) (host string, port uint16, data []byte, err error) {
+	var size uint16
+	if err = binary.Read(r, binary.BigEndian, &size); err != nil {
+		return
+	}
+	buf := make([]byte, size)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		err = fmt.Errorf("failed to read packet: %v", err)
+		return
+	}
+	if len(buf) < 3 || len(buf) < 3+int(buf[0]) {
+		err = errors.New("packet too short")
+		return
+	}
+	hostLen := int(buf[0])
+	host = string(buf[1 : 1+hostLen])
+	port = binary.BigEndian.Uint16(buf[1+hostLen : 3+hostLen])
+	data = buf[3+hostLen:]
+	return
+}
@@ -0,0 +1,67 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		host string
+		port uint16
+		data []byte
+	}{
+		{"ipv4", "192.0.2.1", 53, []byte("query")},
+		{"domain", "example.com", 443, []byte{0, 1, 2, 3}},
+		{"empty data", "::1", 1, nil},
+		{"empty host", "", 0, []byte("x")},
+	}
+	buf := &bytes.Buffer{}
+	for _, tt := range tests {
+		if err := WritePacket(buf, tt.host, tt.port, tt.data); err != nil {
+			t.Fatalf("%s: WritePacket: %v", tt.name, err)
+		}
+	}
+	// Packets are read back from one stream in the order they were written.
+	for _, tt := range tests {
+		host, port, data, err := ReadPacket(buf)
+		if err != nil {
+			t.Fatalf("%s: ReadPacket: %v", tt.name, err)
+		}
+		if host != tt.host || port != tt.port || !bytes.Equal(data, tt.data) {
+			t.Errorf("%s: got %s:%d %q", tt.name, host, port, data)
+		}
+	}
+}
+
+func TestPacketErrors(t *testing.T) {
+	if err := WritePacket(&bytes.Buffer{}, strings.Repeat("a", 256), 1, nil); err == nil {
+		t.Error("WritePacket accepted a 256 byte host")
+	}
+	if err := WritePacket(&bytes.Buffer{}, "a", 1, make([]byte, 65535)); err == nil {
+		t.Error("WritePacket accepted a packet over 64 KiB")
+	}
+	frame := func(body []byte) []byte {
+		out := make([]byte, 2, 2+len(body))
+		binary.BigEndian.PutUint16(out, uint16(len(body)))
+		return append(out, body...)
+	}
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"too short", frame([]byte{0, 0})},
+		{"host past end", frame([]byte{5, 'a', 0, 1})},
+		{"truncated", frame([]byte{1, 'a', 0, 1, 'x'})[:5]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, _, err := ReadPacket(bytes.NewReader(tt.in)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
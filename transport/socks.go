@@ -0,0 +1,128 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/beefsack/go-under-cover/bridge"
+	"github.com/beefsack/go-under-cover/socks"
+)
+
+// SOCKS sends connections through an upstream SOCKS4, SOCKS4a or SOCKS5
+// proxy, such as Tor or a corporate gateway. UDP needs SOCKS5, and bind
+// isn't supported.
+type SOCKS struct {
+	Client *socks.Client
+}
+
+func NewSOCKS(client *socks.Client) *SOCKS {
+	return &SOCKS{Client: client}
+}
+
+func (s *SOCKS) Dial(network, address string) (io.ReadWriteCloser, error) {
+	return s.DialContext(context.Background(), network, address)
+}
+
+func (s *SOCKS) DialContext(ctx context.Context, network, address string) (io.ReadWriteCloser, error) {
+	switch network {
+	case "tcp":
+		conn, err := s.Client.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, &DialError{Code: StatusForError(err), Err: err}
+		}
+		return &socksConn{conn.(*socks.Conn)}, nil
+	case "udp":
+		pc, err := s.Client.ListenPacket(ctx)
+		if err != nil {
+			return nil, &DialError{Code: StatusForError(err), Err: err}
+		}
+		return packetStream(pc), nil
+	}
+	return nil, fmt.Errorf("SOCKS proxies don't support %s", network)
+}
+
+// SupportsDeadlines is true as TCP connections are dialed directly to the
+// proxy.
+func (s *SOCKS) SupportsDeadlines() bool {
+	return true
+}
+
+func (s *SOCKS) Listen() (Listener, error) {
+	return nil, errors.New("SOCKS proxies can't listen")
+}
+
+// socksConn reports the address the proxy connected from as its status.
+type socksConn struct {
+	*socks.Conn
+}
+
+func (c *socksConn) Status() *Status {
+	status := &Status{Code: StatusOK, Port: c.BindPort}
+	if c.BindAddr != nil {
+		status.Host = c.BindAddr.String()
+	}
+	return status
+}
+
+func (c *socksConn) CloseWrite() error {
+	return bridge.CloseWrite(c.Conn.Conn)
+}
+
+// packetStream frames datagrams from pc the same way as a "udp" tunnel
+// stream, closing pc when the stream is closed.
+func packetStream(pc net.PacketConn) io.ReadWriteCloser {
+	local, remote := net.Pipe()
+	go func() {
+		defer local.Close()
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			host, portStr, err := net.SplitHostPort(addr.String())
+			if err != nil {
+				continue
+			}
+			port, _ := strconv.ParseUint(portStr, 10, 16)
+			if err := WritePacket(local, host, uint16(port), buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer pc.Close()
+		for {
+			host, port, data, err := ReadPacket(local)
+			if err != nil {
+				return
+			}
+			addr := newAddr("udp", host, strconv.Itoa(int(port)))
+			if _, err := pc.WriteTo(data, addr); err != nil {
+				logger.Debug("failed to send datagram to %s: %v", addr, err)
+			}
+		}
+	}()
+	return remote
+}
+
+// statusForReply maps a reply from an upstream SOCKS proxy to a status.
+func statusForReply(rep byte) byte {
+	switch rep {
+	case socks.RepConnectionNotAllowedByRuleset:
+		return StatusDenied
+	case socks.RepNetworkUnreachable:
+		return StatusNetworkUnreachable
+	case socks.RepHostUnreachable:
+		return StatusHostUnreachable
+	case socks.RepConnectionRefused:
+		return StatusRefused
+	case socks.RepTTLExpired:
+		return StatusTimeout
+	}
+	return StatusFailure
+}
@@ -0,0 +1,203 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+
+	"github.com/beefsack/go-under-cover/socks"
+	"github.com/beefsack/go-under-cover/transport/mux"
+)
+
+// Status codes sent by the server once it has tried to connect to the
+// destination of a stream.
+const (
+	StatusOK byte = iota
+	StatusFailure
+	StatusDenied
+	StatusNetworkUnreachable
+	StatusHostUnreachable
+	StatusRefused
+	StatusTimeout
+)
+
+var statusText = map[byte]string{
+	StatusOK:                 "ok",
+	StatusFailure:            "general failure",
+	StatusDenied:             "denied by policy",
+	StatusNetworkUnreachable: "network unreachable",
+	StatusHostUnreachable:    "host unreachable",
+	StatusRefused:            "connection refused",
+	StatusTimeout:            "timed out",
+}
+
+func StatusText(code byte) string {
+	if text, ok := statusText[code]; ok {
+		return text
+	}
+	return fmt.Sprintf("unknown status 0x%x", code)
+}
+
+// Status is sent by the server before any data on a stream, and holds the
+// address the server connected from on success.
+type Status struct {
+	Code byte
+	Host string
+	Port uint16
+}
+
+// StatusConn is implemented by connections returned from Dial which know the
+// status the server replied with.
+type StatusConn interface {
+	io.ReadWriteCloser
+	Status() *Status
+}
+
+// BindConn is returned from dialing the "bind" network. Its Status is where
+// the server is listening, and Accept blocks until a connection arrives
+// there, returning the status with the address of the peer.
+type BindConn interface {
+	StatusConn
+	Accept() (*Status, error)
+}
+
+// DialError is returned from Dial when the server failed to connect to the
+// destination.
+type DialError struct {
+	Code byte
+	// Err is the underlying error when the dial failed locally rather than
+	// on the server.
+	Err error
+}
+
+func (e *DialError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("failed to connect: %v", e.Err)
+	}
+	return fmt.Sprintf("server failed to connect: %s", StatusText(e.Code))
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// StatusForError classifies a dial error into a status code.
+func StatusForError(err error) byte {
+	var (
+		dialErr  *DialError
+		replyErr *socks.ReplyError
+		dnsErr   *net.DNSError
+		netErr   net.Error
+	)
+	switch {
+	case err == nil:
+		return StatusOK
+	case errors.As(err, &dialErr):
+		return dialErr.Code
+	case errors.As(err, &replyErr):
+		return statusForReply(replyErr.Reply)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return StatusRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return StatusNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return StatusHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return StatusTimeout
+	}
+	return StatusFailure
+}
+
+// StatusForAddr makes a successful status from the local address of the
+// server's connection to the destination.
+func StatusForAddr(addr net.Addr) *Status {
+	status := &Status{Code: StatusOK}
+	if addr == nil {
+		return status
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return status
+	}
+	p, _ := strconv.ParseUint(port, 10, 16)
+	status.Host = host
+	status.Port = uint16(p)
+	return status
+}
+
+func writeStatus(w io.Writer, status *Status) error {
+	if len(status.Host) > 255 {
+		return fmt.Errorf("%s is too long", status.Host)
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteByte(status.Code)
+	buf.WriteByte(byte(len(status.Host)))
+	buf.WriteString(status.Host)
+	binary.Write(buf, binary.BigEndian, status.Port)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func readStatus(r io.Reader) (*Status, error) {
+	status := &Status{}
+	code := make([]byte, 1)
+	if _, err := io.ReadFull(r, code); err != nil {
+		return nil, fmt.Errorf("failed to read status code: %v", err)
+	}
+	status.Code = code[0]
+	host, err := readString(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read status host: %v", err)
+	}
+	status.Host = host
+	if err := binary.Read(r, binary.BigEndian, &status.Port); err != nil {
+		return nil, fmt.Errorf("failed to read status port: %v", err)
+	}
+	return status, nil
+}
+
+// Reply sends the result of connecting to the destination to the client.
+// It must be called before anything else is written to the Conn.
+func (c *Conn) Reply(status *Status) error {
+	return writeStatus(c.ReadWriteCloser, status)
+}
+
+// statusStream is a dialed stream along with the status the server
+// replied with. Its addresses are those of the server's connection to the
+// destination rather than of the tunnel.
+type statusStream struct {
+	*mux.Stream
+	status *Status
+	remote net.Addr
+}
+
+func (s *statusStream) Status() *Status {
+	return s.status
+}
+
+func (s *statusStream) LocalAddr() net.Addr {
+	if s.status.Host == "" {
+		return s.Stream.LocalAddr()
+	}
+	return newAddr("tcp", s.status.Host, strconv.Itoa(int(s.status.Port)))
+}
+
+func (s *statusStream) RemoteAddr() net.Addr {
+	return s.remote
+}
+
+func (s *statusStream) Accept() (*Status, error) {
+	status, err := readStatus(s.Stream)
+	if err != nil {
+		return nil, err
+	}
+	if status.Code != StatusOK {
+		return nil, &DialError{Code: status.Code}
+	}
+	return status, nil
+}
@@ -0,0 +1,117 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/beefsack/go-under-cover/socks"
+)
+
+func TestStatusRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		status *Status
+	}{
+		{"ok with address", &Status{Code: StatusOK, Host: "203.0.113.5", Port: 41000}},
+		{"ok with IPv6", &Status{Code: StatusOK, Host: "2001:db8::1", Port: 443}},
+		{"failure", &Status{Code: StatusRefused}},
+		{"unknown code", &Status{Code: 0xfe, Host: "x", Port: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			if err := writeStatus(buf, tt.status); err != nil {
+				t.Fatalf("writeStatus: %v", err)
+			}
+			got, err := readStatus(buf)
+			if err != nil {
+				t.Fatalf("readStatus: %v", err)
+			}
+			if *got != *tt.status {
+				t.Errorf("got %+v, want %+v", got, tt.status)
+			}
+			if buf.Len() != 0 {
+				t.Errorf("%d bytes left over", buf.Len())
+			}
+		})
+	}
+}
+
+func TestStatusErrors(t *testing.T) {
+	if err := writeStatus(&bytes.Buffer{}, &Status{Host: strings.Repeat("a", 256)}); err == nil {
+		t.Error("writeStatus accepted a 256 byte host")
+	}
+	buf := &bytes.Buffer{}
+	writeStatus(buf, &Status{Code: StatusOK, Host: "example.com", Port: 80})
+	full := buf.Bytes()
+	for n := 0; n < len(full); n++ {
+		if _, err := readStatus(bytes.NewReader(full[:n])); err == nil {
+			t.Errorf("readStatus accepted %d of %d bytes", n, len(full))
+		}
+	}
+}
+
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+func TestStatusForError(t *testing.T) {
+	opErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want byte
+	}{
+		{"nil", nil, StatusOK},
+		{"dial error", &DialError{Code: StatusDenied}, StatusDenied},
+		{"wrapped dial error", fmt.Errorf("x: %w", &DialError{Code: StatusTimeout}), StatusTimeout},
+		{"refused", opErr(syscall.ECONNREFUSED), StatusRefused},
+		{"network unreachable", opErr(syscall.ENETUNREACH), StatusNetworkUnreachable},
+		{"host unreachable", opErr(syscall.EHOSTUNREACH), StatusHostUnreachable},
+		{"dns", &net.DNSError{Err: "no such host", Name: "nope.invalid"}, StatusHostUnreachable},
+		{"timeout", &net.OpError{Op: "dial", Err: timeoutErr{}}, StatusTimeout},
+		{"context deadline", context.DeadlineExceeded, StatusTimeout},
+		{"proxy refused", &socks.ReplyError{Reply: socks.RepConnectionRefused}, StatusRefused},
+		{"proxy ruleset", fmt.Errorf("x: %w", &socks.ReplyError{Reply: socks.RepConnectionNotAllowedByRuleset}), StatusDenied},
+		{"proxy failure", &socks.ReplyError{Reply: socks.RepGeneralSocksServerFailure}, StatusFailure},
+		{"other", errors.New("boom"), StatusFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := StatusForError(tt.err); got != tt.want {
+				t.Errorf("got %s, want %s", StatusText(got), StatusText(tt.want))
+			}
+		})
+	}
+}
+
+func TestStatusForAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		addr net.Addr
+		want Status
+	}{
+		{"nil", nil, Status{}},
+		{"tcp", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5000}, Status{Host: "192.0.2.1", Port: 5000}},
+		{"udp6", &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 53}, Status{Host: "2001:db8::2", Port: 53}},
+		{"no port", &Addr{Net: "tcp", Address: "example.com"}, Status{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := StatusForAddr(tt.addr); *got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Fingerprint returns the hex encoded SHA-256 hash of the certificate's
+// SubjectPublicKeyInfo, which is what the client pins by default.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseFingerprint decodes a hex encoded SHA-256 fingerprint, optionally
+// separated with colons.
+func ParseFingerprint(fingerprint string) ([]byte, error) {
+	raw, err := hex.DecodeString(strings.Replace(fingerprint, ":", "", -1))
+	if err != nil {
+		return nil, fmt.Errorf("fingerprint is not valid hex: %v", err)
+	}
+	if len(raw) != sha256.Size {
+		return nil, fmt.Errorf(
+			"expected fingerprint to be %d bytes, got %d",
+			sha256.Size,
+			len(raw),
+		)
+	}
+	return raw, nil
+}
+
+// tlsConfig builds the client TLS config. The server certificate is
+// verified against the system roots unless a CA file is given, and if a
+// fingerprint is given the certificate must also match it, either by its
+// SubjectPublicKeyInfo or by the whole certificate. A fingerprint on its own
+// skips chain verification so self-signed certificates can be pinned.
+func (wss *WSSPlain) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+	if wss.CAFile != "" {
+		pem, err := os.ReadFile(wss.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", wss.CAFile, err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", wss.CAFile)
+		}
+	}
+	if wss.Fingerprint == "" {
+		return config, nil
+	}
+
+	pin, err := ParseFingerprint(wss.Fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	verifyChain := wss.CAFile != ""
+	config.InsecureSkipVerify = !verifyChain
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("server sent no certificate")
+		}
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse server certificate: %v", err)
+		}
+		spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+		whole := sha256.Sum256(leaf.Raw)
+		if !bytes.Equal(pin, spki[:]) && !bytes.Equal(pin, whole[:]) {
+			return fmt.Errorf(
+				"server certificate fingerprint %s does not match pinned fingerprint",
+				Fingerprint(leaf),
+			)
+		}
+		return nil
+	}
+	return config, nil
+}
@@ -0,0 +1,84 @@
+package transport
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTLSConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	cert := srv.Certificate()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cert.Raw,
+	}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	emptyCA := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(emptyCA, []byte("no certificates"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	spki := Fingerprint(cert)
+	whole := sha256.Sum256(cert.Raw)
+	other := strings.Repeat("00", sha256.Size)
+	tests := []struct {
+		name        string
+		fingerprint string
+		caFile      string
+		wantConfig  bool
+		wantConnect bool
+	}{
+		// The test certificate isn't trusted by the system roots.
+		{"system roots", "", "", true, false},
+		{"ca file", "", caFile, true, true},
+		{"spki pin", spki, "", true, true},
+		{"spki pin with colons", colonSeparated(spki), "", true, true},
+		{"whole certificate pin", hex.EncodeToString(whole[:]), "", true, true},
+		// A pin on its own skips chain verification, but is still checked.
+		{"mismatched pin", other, "", true, false},
+		{"ca file and pin", spki, caFile, true, true},
+		{"ca file and mismatched pin", other, caFile, true, false},
+		{"missing ca file", "", filepath.Join(t.TempDir(), "missing.pem"), false, false},
+		{"ca file without certificates", "", emptyCA, false, false},
+		{"invalid pin", "not hex", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wss := NewWSSPlain(srv.Listener.Addr().String())
+			wss.Fingerprint = tt.fingerprint
+			wss.CAFile = tt.caFile
+			config, err := wss.tlsConfig()
+			if (err == nil) != tt.wantConfig {
+				t.Fatalf("got error %v, want config %v", err, tt.wantConfig)
+			}
+			if err != nil {
+				return
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+			res, err := client.Get(srv.URL)
+			if err == nil {
+				res.Body.Close()
+			}
+			if (err == nil) != tt.wantConnect {
+				t.Errorf("got error %v, want connect %v", err, tt.wantConnect)
+			}
+		})
+	}
+}
+
+func colonSeparated(fingerprint string) string {
+	var pairs []string
+	for i := 0; i < len(fingerprint); i += 2 {
+		pairs = append(pairs, fingerprint[i:i+2])
+	}
+	return strings.Join(pairs, ":")
+}
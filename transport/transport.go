@@ -1,8 +1,56 @@
 package transport
 
-import "io"
+import (
+	"context"
+	"io"
+	"net"
+
+	"github.com/beefsack/go-under-cover/bridge"
+	"github.com/beefsack/go-under-cover/llog"
+)
+
+var logger = llog.Named("transport")
 
 type Transport interface {
 	Dial(network, address string) (io.ReadWriteCloser, error)
-	Listen() error
+	Listen() (Listener, error)
+}
+
+// ContextDialer is a Transport which can dial with a context, logging with
+// the fields of the logger it carries.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (io.ReadWriteCloser, error)
+}
+
+// DialContext dials through trans with ctx if it is a ContextDialer.
+func DialContext(ctx context.Context, trans Transport, network, address string) (io.ReadWriteCloser, error) {
+	if cd, ok := trans.(ContextDialer); ok {
+		return cd.DialContext(ctx, network, address)
+	}
+	return trans.Dial(network, address)
+}
+
+type Listener interface {
+	Accept() (*Conn, error)
+	Close() error
+	// Shutdown stops accepting and waits for open streams to finish until
+	// ctx is done, then closes whatever is left.
+	Shutdown(ctx context.Context) error
+	Addr() net.Addr
+}
+
+// Conn is a tunnel stream accepted by a Listener, along with the destination
+// the client asked the server to connect to.
+type Conn struct {
+	io.ReadWriteCloser
+	Network    string
+	Host       string
+	Port       string
+	RemoteAddr net.Addr
+	// User is who the client authenticated as, if authentication is enabled.
+	User string
+}
+
+func (c *Conn) CloseWrite() error {
+	return bridge.CloseWrite(c.ReadWriteCloser)
 }
@@ -0,0 +1,146 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsPingInterval = 30 * time.Second
+	wsPongTimeout  = 3 * wsPingInterval
+	wsCloseTimeout = time.Second
+)
+
+// wsConn is a net.Conn which carries its data in binary WebSocket messages
+// instead of writing to the underlying connection directly.
+type wsConn struct {
+	ws       *websocket.Conn
+	reader   io.Reader
+	readMu   sync.Mutex
+	writeMu  sync.Mutex
+	lastPong int64
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newWSConn(ws *websocket.Conn) *wsConn {
+	c := &wsConn{
+		ws:       ws,
+		lastPong: time.Now().UnixNano(),
+		done:     make(chan struct{}),
+	}
+	ws.SetPongHandler(func(string) error {
+		atomic.StoreInt64(&c.lastPong, time.Now().UnixNano())
+		return nil
+	})
+	go c.keepAlive()
+	return c
+}
+
+func (c *wsConn) keepAlive() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			last := time.Unix(0, atomic.LoadInt64(&c.lastPong))
+			if now.Sub(last) > wsPongTimeout {
+				c.ws.Close()
+				return
+			}
+			if err := c.ws.WriteControl(
+				websocket.PingMessage,
+				nil,
+				now.Add(wsPingInterval),
+			); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for {
+		if c.reader == nil {
+			typ, r, err := c.ws.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(
+					err,
+					websocket.CloseNormalClosure,
+					websocket.CloseGoingAway,
+				) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if typ != websocket.BinaryMessage {
+				continue
+			}
+			c.reader = r
+		}
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.done)
+		c.ws.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(wsCloseTimeout),
+		)
+		err = c.ws.Close()
+	})
+	return err
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
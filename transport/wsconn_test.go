@@ -0,0 +1,112 @@
+package transport
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsPair upgrades a connection to a test server, returning the server end
+// wrapped in a wsConn and the plain client end.
+func wsPair(t *testing.T) (*wsConn, *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *wsConn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("failed to upgrade: %v", err)
+			return
+		}
+		conns <- newWSConn(ws)
+	}))
+	t.Cleanup(srv.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	server := <-conns
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	return server, client
+}
+
+func TestWSConnWritesBinaryMessages(t *testing.T) {
+	server, client := wsPair(t)
+	for _, msg := range []string{"hello", "world"} {
+		if _, err := server.Write([]byte(msg)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	for _, want := range []string{"hello", "world"} {
+		typ, got, err := client.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %v", err)
+		}
+		if typ != websocket.BinaryMessage || string(got) != want {
+			t.Errorf("got message type %d %q, want binary %q", typ, got, want)
+		}
+	}
+}
+
+func TestWSConnReadsBinaryMessages(t *testing.T) {
+	server, client := wsPair(t)
+	client.WriteMessage(websocket.BinaryMessage, []byte("abc"))
+	client.WriteMessage(websocket.TextMessage, []byte("ignored"))
+	client.WriteMessage(websocket.BinaryMessage, nil)
+	client.WriteMessage(websocket.BinaryMessage, []byte("def"))
+	client.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	got, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "abcdef" {
+		t.Errorf("got %q, want %q", got, "abcdef")
+	}
+}
+
+func TestWSConnPingAndClose(t *testing.T) {
+	server, client := wsPair(t)
+	// The server answers pings while it reads.
+	go io.Copy(ioutil.Discard, server)
+	pong := make(chan string, 1)
+	client.SetPongHandler(func(data string) error {
+		pong <- data
+		return nil
+	})
+	if err := client.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("failed to ping: %v", err)
+	}
+	closed := make(chan error, 1)
+	go func() {
+		_, _, err := client.ReadMessage()
+		closed <- err
+	}()
+	select {
+	case data := <-pong:
+		if data != "ping" {
+			t.Errorf("got pong %q, want %q", data, "ping")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no pong")
+	}
+	server.Close()
+	select {
+	case err := <-closed:
+		if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			t.Errorf("got %v, want a normal close frame", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no close frame")
+	}
+}
@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -8,51 +9,425 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
 
+	"github.com/beefsack/go-under-cover/metrics"
+	"github.com/beefsack/go-under-cover/transport/mux"
 	"github.com/gorilla/websocket"
 )
 
+const (
+	DefaultPath        = "/ws"
+	DefaultSubprotocol = "chat"
+	DefaultBufferSize  = 1024
+	// DefaultHandshakeTimeout covers connecting, TLS and the WebSocket
+	// upgrade.
+	DefaultHandshakeTimeout = 10 * time.Second
+
+	shutdownPollInterval = 500 * time.Millisecond
+)
+
+var ErrListenerClosed = errors.New("listener closed")
+
+// WSSPlain tunnels streams over a single multiplexed WebSocket connection
+// to the server.
 type WSSPlain struct {
 	Address string
+	// Path is the URL path of the tunnel endpoint.
+	Path string
+	// Subprotocol is the WebSocket subprotocol sent in the handshake.
+	Subprotocol string
+	// BufferSize is the size of the WebSocket read and write buffers.
+	BufferSize int
+	// HandshakeTimeout limits connecting, the TLS handshake and the
+	// WebSocket upgrade when dialing, and reading request headers when
+	// listening. There is no limit if it is zero.
+	HandshakeTimeout time.Duration
+	// Fingerprint pins the server certificate by its SHA-256 fingerprint.
+	Fingerprint string
+	// CAFile is a PEM bundle used instead of the system roots to verify the
+	// server certificate.
+	CAFile string
+	// User and Key sign the handshake token when dialing. They are ignored
+	// if Key is empty.
+	User     string
+	Key      []byte
+	CertFile string
+	KeyFile  string
+	// Auth verifies handshake tokens when listening. If it is nil clients
+	// aren't authenticated.
+	Auth Verifier
+	// Fallback serves every request that isn't a tunnel request when
+	// listening.
+	Fallback  http.Handler
+	MuxConfig *mux.Config
+
+	mu      sync.Mutex
+	session *mux.Session
 }
 
 func NewWSSPlain(address string) *WSSPlain {
 	return &WSSPlain{
-		Address: address,
+		Address:          address,
+		Path:             DefaultPath,
+		Subprotocol:      DefaultSubprotocol,
+		BufferSize:       DefaultBufferSize,
+		HandshakeTimeout: DefaultHandshakeTimeout,
 	}
 }
 
 func (wss *WSSPlain) Dial(network, address string) (io.ReadWriteCloser, error) {
-	rawConn, err := tls.Dial("tcp", wss.Address, &tls.Config{
-		InsecureSkipVerify: true,
-	})
+	return wss.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the server and waits for the request to be
+// answered until ctx's deadline.
+func (wss *WSSPlain) DialContext(ctx context.Context, network, address string) (io.ReadWriteCloser, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to split address: %v", err)
+	}
+
+	var stream *mux.Stream
+	// A session which has silently died is only noticed when opening a
+	// stream on it, so try once more with a fresh session.
+	for attempt := 0; attempt < 2; attempt++ {
+		var session *mux.Session
+		if session, err = wss.getSession(ctx); err != nil {
+			return nil, err
+		}
+		if stream, err = session.OpenStream(); err == nil {
+			break
+		}
+		wss.dropSession(session)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream: %v", err)
+	}
+
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		stream.SetDeadline(deadline)
+	}
+	if err := writeRequest(stream, network, host, port); err != nil {
+		stream.Reset()
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+	status, err := readStatus(stream)
+	if err != nil {
+		stream.Reset()
+		return nil, fmt.Errorf("failed to read status: %v", err)
+	}
+	if status.Code != StatusOK {
+		stream.Close()
+		return nil, &DialError{Code: status.Code}
+	}
+	if hasDeadline {
+		stream.SetDeadline(time.Time{})
+	}
+	return &statusStream{stream, status, newAddr(network, host, port)}, nil
+}
+
+// SupportsDeadlines is true as streams support deadlines.
+func (wss *WSSPlain) SupportsDeadlines() bool {
+	return true
+}
+
+func (wss *WSSPlain) getSession(ctx context.Context) (*mux.Session, error) {
+	wss.mu.Lock()
+	defer wss.mu.Unlock()
+	if wss.session != nil && !wss.session.IsClosed() {
+		return wss.session, nil
+	}
+	conn, err := wss.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	wss.session = mux.Client(conn, wss.MuxConfig)
+	trackSession(wss.session)
+	return wss.session, nil
+}
+
+// dropSession stops session being used for new streams, closing it once the
+// streams already open on it end.
+func (wss *WSSPlain) dropSession(session *mux.Session) {
+	wss.mu.Lock()
+	if wss.session == session {
+		wss.session = nil
+	}
+	wss.mu.Unlock()
+	session.Drain()
+}
+
+func (wss *WSSPlain) connect(ctx context.Context) (net.Conn, error) {
+	tlsConfig, err := wss.tlsConfig()
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS configuration: %v", err)
+	}
+	dialer := websocket.Dialer{
+		ReadBufferSize:   wss.BufferSize,
+		WriteBufferSize:  wss.BufferSize,
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: wss.HandshakeTimeout,
+	}
+	header := http.Header{}
+	if wss.Subprotocol != "" {
+		header.Set("Sec-Websocket-Protocol", wss.Subprotocol)
+	}
+	if len(wss.Key) > 0 {
+		token, err := NewToken(wss.User, wss.Key, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create auth token: %v", err)
+		}
+		header.Set("Cookie", (&http.Cookie{Name: authCookie, Value: token}).String())
+	}
+	u := &url.URL{
+		Scheme: "wss",
+		Host:   wss.Address,
+		Path:   wss.Path,
+	}
+	start := time.Now()
+	ws, _, err := dialer.DialContext(ctx, u.String(), header)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to server: %v", err)
 	}
+	metrics.HandshakeSeconds.ObserveSince(start, "wss")
+	logger.Debug("connected to %s", wss.Address)
+	return newWSConn(ws), nil
+}
 
-	u, err := url.Parse(fmt.Sprintf("wss://%s/ws", wss.Address))
+func (wss *WSSPlain) Listen() (Listener, error) {
+	cert, err := tls.LoadX509KeyPair(wss.CertFile, wss.KeyFile)
 	if err != nil {
-		return nil, fmt.Errorf("invalid proxy address: %v", err)
+		return nil, fmt.Errorf("failed to load key pair: %v", err)
 	}
-	query := url.Values{}
-	host, port, err := net.SplitHostPort(address)
+	ln, err := net.Listen("tcp", wss.Address)
 	if err != nil {
-		return nil, fmt.Errorf("failed to split address: %v", err)
+		return nil, fmt.Errorf("failed to listen on %s: %v", wss.Address, err)
+	}
+	l := &wssListener{
+		ln:        ln,
+		fallback:  wss.Fallback,
+		auth:      wss.Auth,
+		muxConfig: wss.MuxConfig,
+		header:    http.Header{},
+		sessions:  map[*mux.Session]bool{},
+		conns:     make(chan *Conn),
+		done:      make(chan struct{}),
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  wss.BufferSize,
+			WriteBufferSize: wss.BufferSize,
+			CheckOrigin:     func(r *http.Request) bool { return true },
+		},
 	}
-	query.Set("network", network)
-	query.Set("host", host)
-	query.Set("port", port)
-	u.RawQuery = query.Encode()
+	if wss.Subprotocol != "" {
+		l.header.Set("Sec-Websocket-Protocol", wss.Subprotocol)
+	}
+	if l.fallback == nil {
+		l.fallback = http.NotFoundHandler()
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(wss.Path, l.handleWS)
+	mux.Handle("/", l.fallback)
+	l.server = &http.Server{
+		Handler: mux,
+		// This also bounds the TLS handshake.
+		ReadHeaderTimeout: wss.HandshakeTimeout,
+	}
+	go func() {
+		l.closeWithErr(l.server.Serve(tls.NewListener(ln, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		})))
+	}()
+	return l, nil
+}
+
+type wssListener struct {
+	ln        net.Listener
+	server    *http.Server
+	fallback  http.Handler
+	auth      Verifier
+	upgrader  websocket.Upgrader
+	muxConfig *mux.Config
+	header    http.Header
+
+	sessionsMu sync.Mutex
+	sessions   map[*mux.Session]bool
+
+	conns chan *Conn
+	done  chan struct{}
+	once  sync.Once
+	err   error
+}
+
+func (l *wssListener) Accept() (*Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *wssListener) Close() error {
+	l.closeWithErr(ErrListenerClosed)
+	err := l.server.Close()
+	l.closeSessions()
+	return err
+}
+
+func (l *wssListener) Shutdown(ctx context.Context) error {
+	l.closeWithErr(ErrListenerClosed)
+	// WebSocket connections are hijacked, so this only waits for decoy
+	// requests.
+	if err := l.server.Shutdown(ctx); err != nil {
+		l.closeSessions()
+		return err
+	}
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		n := l.numStreams()
+		if n == 0 {
+			l.closeSessions()
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			logger.Warn("closing %d streams still active", n)
+			l.closeSessions()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l *wssListener) numStreams() int {
+	l.sessionsMu.Lock()
+	defer l.sessionsMu.Unlock()
+	n := 0
+	for session := range l.sessions {
+		n += session.NumStreams()
+	}
+	return n
+}
+
+func (l *wssListener) closeSessions() {
+	l.sessionsMu.Lock()
+	defer l.sessionsMu.Unlock()
+	for session := range l.sessions {
+		session.Close()
+	}
+}
+
+func (l *wssListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+func (l *wssListener) closeWithErr(err error) {
+	l.once.Do(func() {
+		if err == http.ErrServerClosed {
+			err = ErrListenerClosed
+		}
+		l.err = err
+		close(l.done)
+	})
+}
+
+func (l *wssListener) handleWS(w http.ResponseWriter, r *http.Request) {
+	logger.Debug("WS %s %s", r.URL.Path, r.RemoteAddr)
+	start := time.Now()
+	if !websocket.IsWebSocketUpgrade(r) {
+		l.fallback.ServeHTTP(w, r)
+		return
+	}
+	var user string
+	if l.auth != nil {
+		var err error
+		if user, err = l.authenticate(r); err != nil {
+			// Unauthenticated clients get the same response as anyone else
+			// browsing the site.
+			logger.Info("rejected client %s: %v", r.RemoteAddr, err)
+			l.fallback.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	ws, err := l.upgrader.Upgrade(w, r, l.header)
+	if err != nil {
+		logger.Warn("failed upgrading connection to websocket: %v", err)
+		return
+	}
+	metrics.HandshakeSeconds.ObserveSince(start, "wss")
+	session := mux.Server(newWSConn(ws), l.muxConfig)
+	trackSession(session)
+	l.sessionsMu.Lock()
+	l.sessions[session] = true
+	l.sessionsMu.Unlock()
+	go l.serveSession(session, ws.RemoteAddr(), user)
+}
+
+// trackSession counts session as active until it closes.
+func trackSession(session *mux.Session) {
+	metrics.ActiveSessions.Inc()
+	go func() {
+		<-session.CloseChan()
+		metrics.ActiveSessions.Dec()
+	}()
+}
 
-	ws, _, err := websocket.NewClient(rawConn, u, http.Header{
-		"Sec-Websocket-Protocol": {"chat"},
-	}, 1024, 1024)
+func (l *wssListener) authenticate(r *http.Request) (string, error) {
+	cookie, err := r.Cookie(authCookie)
 	if err != nil {
-		return nil, fmt.Errorf("failed to upgrade to websocket: %v", err)
+		return "", errors.New("no auth token")
 	}
-	return ws.UnderlyingConn(), nil
+	return l.auth.Verify(cookie.Value, time.Now())
 }
 
-func (wss *WSSPlain) Listen() error {
-	return errors.New("not implemented")
+func (l *wssListener) serveSession(
+	session *mux.Session,
+	remoteAddr net.Addr,
+	user string,
+) {
+	defer func() {
+		session.Close()
+		l.sessionsMu.Lock()
+		delete(l.sessions, session)
+		l.sessionsMu.Unlock()
+	}()
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			logger.Debug("session from %s ended: %v", remoteAddr, err)
+			return
+		}
+		go l.handleStream(stream, remoteAddr, user)
+	}
+}
+
+func (l *wssListener) handleStream(
+	stream *mux.Stream,
+	remoteAddr net.Addr,
+	user string,
+) {
+	network, host, port, err := readRequest(stream)
+	if err != nil {
+		logger.Warn("failed to read request from %s: %v", remoteAddr, err)
+		stream.Reset()
+		return
+	}
+	conn := &Conn{
+		ReadWriteCloser: stream,
+		Network:         network,
+		Host:            host,
+		Port:            port,
+		RemoteAddr:      remoteAddr,
+		User:            user,
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		stream.Reset()
+	}
 }
@@ -0,0 +1,159 @@
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate and its key, returning
+// their paths and the certificate's fingerprint.
+func writeTestCert(t *testing.T) (string, string, string) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile, Fingerprint(cert)
+}
+
+// listenWSS listens on loopback, returning the listener and a transport
+// which dials it.
+func listenWSS(t *testing.T) (Listener, *WSSPlain) {
+	t.Helper()
+	certFile, keyFile, fingerprint := writeTestCert(t)
+	server := NewWSSPlain("127.0.0.1:0")
+	server.CertFile = certFile
+	server.KeyFile = keyFile
+	l, err := server.Listen()
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	client := NewWSSPlain(l.Addr().String())
+	client.Fingerprint = fingerprint
+	return l, client
+}
+
+func TestWSSListen(t *testing.T) {
+	l, client := listenWSS(t)
+	tests := []struct {
+		name     string
+		network  string
+		address  string
+		wantHost string
+		wantPort string
+		status   *Status
+	}{
+		{"ipv4", "tcp", "192.0.2.1:80", "192.0.2.1", "80", &Status{Code: StatusOK, Host: "198.51.100.1", Port: 40000}},
+		{"ipv6", "tcp", "[2001:db8::1]:443", "2001:db8::1", "443", &Status{Code: StatusOK}},
+		{"domain", "tcp", "example.com:8080", "example.com", "8080", &Status{Code: StatusOK}},
+		{"udp", "udp", "192.0.2.1:53", "192.0.2.1", "53", &Status{Code: StatusOK}},
+		{"refused", "tcp", "192.0.2.1:81", "192.0.2.1", "81", &Status{Code: StatusRefused}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			type dialed struct {
+				conn io.ReadWriteCloser
+				err  error
+			}
+			dialc := make(chan dialed, 1)
+			go func() {
+				conn, err := client.Dial(tt.network, tt.address)
+				dialc <- dialed{conn, err}
+			}()
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatalf("Accept: %v", err)
+			}
+			defer conn.Close()
+			if conn.Network != tt.network || conn.Host != tt.wantHost || conn.Port != tt.wantPort {
+				t.Errorf("accepted %s %s port %s, want %s %s port %s",
+					conn.Network, conn.Host, conn.Port, tt.network, tt.wantHost, tt.wantPort)
+			}
+			if err := conn.Reply(tt.status); err != nil {
+				t.Fatalf("Reply: %v", err)
+			}
+			d := <-dialc
+			if tt.status.Code != StatusOK {
+				var dialErr *DialError
+				if !errors.As(d.err, &dialErr) || dialErr.Code != tt.status.Code {
+					t.Errorf("Dial returned %v, want status %s", d.err, StatusText(tt.status.Code))
+				}
+				return
+			}
+			if d.err != nil {
+				t.Fatalf("Dial: %v", d.err)
+			}
+			defer d.conn.Close()
+			sc, ok := d.conn.(StatusConn)
+			if !ok {
+				t.Fatalf("dialed %T, want a StatusConn", d.conn)
+			}
+			if *sc.Status() != *tt.status {
+				t.Errorf("dialed connection has status %+v, want %+v", sc.Status(), tt.status)
+			}
+			d.conn.Write([]byte("ping"))
+			got := make([]byte, 4)
+			if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+				t.Fatalf("server read %q, %v", got, err)
+			}
+			conn.Write([]byte("pong"))
+			if _, err := io.ReadFull(d.conn, got); err != nil || string(got) != "pong" {
+				t.Fatalf("client read %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestWSSListenShutdown(t *testing.T) {
+	l, _ := listenWSS(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := l.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if _, err := l.Accept(); err != ErrListenerClosed {
+		t.Errorf("Accept after Shutdown returned %v, want ErrListenerClosed", err)
+	}
+}
+
+func TestWSSListenMissingCert(t *testing.T) {
+	wss := NewWSSPlain("127.0.0.1:0")
+	wss.CertFile = filepath.Join(t.TempDir(), "missing.pem")
+	wss.KeyFile = wss.CertFile
+	if _, err := wss.Listen(); err == nil {
+		t.Error("Listen succeeded without a certificate")
+	}
+}
@@ -0,0 +1,110 @@
+package undercover
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/beefsack/go-under-cover/transport"
+	"github.com/manveru/faker"
+)
+
+// GenerateCert writes a new private key to keyFile and a self-signed
+// certificate for it to certFile, returning the certificate's fingerprint.
+func GenerateCert(certFile, keyFile string) (string, error) {
+	priv, err := genKey(keyFile)
+	if err != nil {
+		return "", err
+	}
+	return genCert(certFile, priv)
+}
+
+func genKey(path string) (*rsa.PrivateKey, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate private key: %v", err)
+	}
+	file, err := os.OpenFile(
+		path,
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		0600,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	if err := pem.Encode(file, &pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(priv),
+	}); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := file.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close %s: %v", path, err)
+	}
+	return priv, nil
+}
+
+func genCert(path string, priv *rsa.PrivateKey) (string, error) {
+	fak, err := faker.New("en")
+	if err != nil {
+		return "", fmt.Errorf("failed to create faker: %v", err)
+	}
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate a serial number: %v", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{fak.CompanyName()},
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(7300 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	cert, err := x509.CreateCertificate(
+		rand.Reader,
+		&template,
+		&template,
+		&priv.PublicKey,
+		priv,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate certificate: %v", err)
+	}
+
+	file, err := os.OpenFile(
+		path,
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		0600,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	if err := pem.Encode(file, &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cert,
+	}); err != nil {
+		return "", fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := file.Close(); err != nil {
+		return "", fmt.Errorf("failed to close %s: %v", path, err)
+	}
+
+	parsed, err := x509.ParseCertificate(cert)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse generated certificate: %v", err)
+	}
+	return transport.Fingerprint(parsed), nil
+}
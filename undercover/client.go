@@ -0,0 +1,213 @@
+// Package undercover runs the client and server so they can be embedded in
+// other programs. The client and server commands are thin wrappers around
+// it.
+package undercover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/beefsack/go-under-cover/bridge"
+	"github.com/beefsack/go-under-cover/httpproxy"
+	"github.com/beefsack/go-under-cover/llog"
+	"github.com/beefsack/go-under-cover/sniff"
+	"github.com/beefsack/go-under-cover/socks"
+	"github.com/beefsack/go-under-cover/transport"
+)
+
+// ErrNotStarted is returned when waiting for or stopping a client or server
+// which hasn't been started.
+var ErrNotStarted = errors.New("undercover: not started")
+
+type ClientOptions struct {
+	// Listen is the address to accept both SOCKS and HTTP proxy requests
+	// on.
+	Listen string
+	// Transport carries proxied connections, and would usually be a
+	// *transport.WSSPlain or a *route.Router.
+	Transport transport.Transport
+	// HandshakeTimeout limits SOCKS negotiation and reading HTTP request
+	// headers, and is disabled if zero.
+	HandshakeTimeout time.Duration
+	Bridge           *bridge.Options
+	// Credentials, when set, requires SOCKS5 and HTTP proxy clients to log
+	// in.
+	Credentials socks.CredentialChecker
+	// AllowUserID, when set, decides which SOCKS4 USERIDs are allowed. If
+	// Credentials is set and this isn't, SOCKS4 is refused.
+	AllowUserID socks.UserIDChecker
+	Logger      *llog.Logger
+}
+
+func DefaultClientOptions() *ClientOptions {
+	return &ClientOptions{
+		Listen:           ":1080",
+		HandshakeTimeout: socks.DefaultHandshakeTimeout,
+		Bridge:           bridge.DefaultOptions(),
+		Logger:           llog.Named("client"),
+	}
+}
+
+// Client serves SOCKS and HTTP proxy requests on one port, sending them
+// through its transport.
+type Client struct {
+	opts *ClientOptions
+
+	mu          sync.Mutex
+	ln          net.Listener
+	sniffer     *sniff.Mux
+	socksServer *socks.Server
+	httpServer  *http.Server
+	httpProxy   *httpproxy.Proxy
+	// cancel ends the context connections are bridged with.
+	cancel  context.CancelFunc
+	done    chan struct{}
+	errOnce sync.Once
+	err     error
+}
+
+func NewClient(opts *ClientOptions) *Client {
+	if opts == nil {
+		opts = DefaultClientOptions()
+	}
+	return &Client{opts: opts}
+}
+
+// Start listens and serves in the background until Shutdown is called or
+// serving fails, which Wait reports.
+func (c *Client) Start(ctx context.Context) error {
+	opts := c.opts
+	if opts.Transport == nil {
+		return errors.New("undercover: client needs a transport")
+	}
+	log := opts.Logger
+	if log == nil {
+		log = llog.Named("client")
+	}
+	ver := &socks.Socks45{}
+	httpProxy := httpproxy.New(opts.Transport)
+	httpProxy.Bridge = opts.Bridge
+	if opts.Credentials != nil {
+		ver.Socks5.Credentials = opts.Credentials
+		httpProxy.Credentials = opts.Credentials
+		// SOCKS4 can't authenticate, so without an allowlist it would be a
+		// way around the credentials.
+		ver.Socks4A.AllowUserID = socks.AllowUserIDs()
+	}
+	if opts.AllowUserID != nil {
+		ver.Socks4A.AllowUserID = opts.AllowUserID
+	}
+
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "tcp", opts.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %v", err)
+	}
+	sniffer := sniff.New(ln)
+	hctx, cancel := context.WithCancel(context.Background())
+	socksServer := socks.NewServer(
+		ver,
+		sniffer.Match(sniff.SOCKS),
+		socksHandler(hctx, opts.Transport, opts.Bridge, log),
+	)
+	socksServer.HandshakeTimeout = opts.HandshakeTimeout
+	httpLn := sniffer.Match(sniff.HTTP)
+	httpServer := &http.Server{
+		Handler:           httpProxy,
+		ReadHeaderTimeout: opts.HandshakeTimeout,
+	}
+
+	c.mu.Lock()
+	c.ln = ln
+	c.sniffer = sniffer
+	c.socksServer = socksServer
+	c.httpServer = httpServer
+	c.httpProxy = httpProxy
+	c.cancel = cancel
+	c.done = make(chan struct{})
+	c.mu.Unlock()
+
+	go func() {
+		if err := httpServer.Serve(httpLn); err != nil &&
+			err != sniff.ErrClosed && err != http.ErrServerClosed {
+			c.fail(fmt.Errorf("failed to serve HTTP: %v", err))
+		}
+	}()
+	go func() {
+		if err := socksServer.Serve(context.Background()); err != nil &&
+			err != sniff.ErrClosed && err != socks.ErrServerClosed {
+			c.fail(fmt.Errorf("failed to serve SOCKS: %v", err))
+		}
+	}()
+	go func() {
+		if err := sniffer.Serve(); err != nil && err != sniff.ErrClosed {
+			c.fail(fmt.Errorf("failed to listen: %v", err))
+		}
+		close(c.done)
+	}()
+	log.Info("listening on %s", ln.Addr())
+	return nil
+}
+
+// fail records the first error serving failed with and stops listening.
+func (c *Client) fail(err error) {
+	c.errOnce.Do(func() {
+		c.err = err
+	})
+	c.sniffer.Close()
+}
+
+// Addr is the address the client is listening on, once started.
+func (c *Client) Addr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ln == nil {
+		return nil
+	}
+	return c.ln.Addr()
+}
+
+// Wait blocks until the client stops listening, returning the error it
+// failed with if it wasn't stopped by Shutdown.
+func (c *Client) Wait() error {
+	c.mu.Lock()
+	done := c.done
+	c.mu.Unlock()
+	if done == nil {
+		return ErrNotStarted
+	}
+	<-done
+	return c.err
+}
+
+// Shutdown stops listening and waits for open connections to finish,
+// closing any left once ctx is done.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	sniffer, socksServer, httpServer, httpProxy := c.sniffer, c.socksServer, c.httpServer, c.httpProxy
+	cancel := c.cancel
+	c.mu.Unlock()
+	if sniffer == nil {
+		return ErrNotStarted
+	}
+	defer cancel()
+	stop := cancelOnDone(ctx, cancel)
+	defer stop()
+	sniffer.Close()
+	done := make(chan error, 3)
+	go func() { done <- socksServer.Shutdown(ctx) }()
+	go func() { done <- httpServer.Shutdown(ctx) }()
+	go func() { done <- httpProxy.Shutdown(ctx) }()
+	var err error
+	for i := 0; i < 3; i++ {
+		if serr := <-done; serr != nil && err == nil {
+			err = serr
+		}
+	}
+	return err
+}
@@ -0,0 +1,161 @@
+package undercover
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const DefaultServerHeader = "nginx"
+
+const defaultIndex = `<!DOCTYPE html>
+<html>
+<head>
+<title>Welcome to %[1]s!</title>
+<style>
+    body {
+        width: 35em;
+        margin: 0 auto;
+        font-family: Tahoma, Verdana, Arial, sans-serif;
+    }
+</style>
+</head>
+<body>
+<h1>Welcome to %[1]s!</h1>
+<p>If you see this page, the web server is successfully installed and
+working. Further configuration is required.</p>
+
+<p><em>Thank you for using %[1]s.</em></p>
+</body>
+</html>
+`
+
+const errorPage = `<html>
+<head><title>%[1]d %[2]s</title></head>
+<body>
+<center><h1>%[1]d %[2]s</h1></center>
+<hr><center>%[3]s</center>
+</body>
+</html>
+`
+
+// decoy serves everything which isn't a tunnel request, so the server looks
+// like an ordinary web server to anyone probing it. It proxies to an
+// upstream web app if one is given, otherwise serves a static directory, or
+// failing that a default welcome page.
+type decoy struct {
+	dir          string
+	upstream     http.Handler
+	serverHeader string
+}
+
+// NewDecoy returns a handler for ServerOptions.Decoy which sends
+// serverHeader as the Server header.
+func NewDecoy(dir, upstream, serverHeader string) (http.Handler, error) {
+	d := &decoy{
+		dir:          dir,
+		serverHeader: serverHeader,
+	}
+	if upstream != "" {
+		u, err := url.Parse(upstream)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream %s: %v", upstream, err)
+		}
+		proxy := httputil.NewSingleHostReverseProxy(u)
+		proxy.ModifyResponse = func(res *http.Response) error {
+			if res.Header.Get("Server") == "" && serverHeader != "" {
+				res.Header.Set("Server", serverHeader)
+			}
+			return nil
+		}
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			if d.serverHeader != "" {
+				w.Header().Set("Server", d.serverHeader)
+			}
+			d.error(w, http.StatusBadGateway)
+		}
+		d.upstream = proxy
+	}
+	if dir != "" {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", dir)
+		}
+	}
+	return d, nil
+}
+
+func (d *decoy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if d.upstream != nil {
+		d.upstream.ServeHTTP(w, r)
+		return
+	}
+	if d.serverHeader != "" {
+		w.Header().Set("Server", d.serverHeader)
+	}
+	switch {
+	case d.dir != "":
+		d.serveFile(w, r)
+	case r.URL.Path == "/" || r.URL.Path == "/index.html":
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, defaultIndex, d.name())
+	default:
+		d.error(w, http.StatusNotFound)
+	}
+}
+
+func (d *decoy) serveFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		d.error(w, http.StatusMethodNotAllowed)
+		return
+	}
+	name := filepath.Join(d.dir, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+	if info, err := os.Stat(name); err == nil && info.IsDir() {
+		name = filepath.Join(name, "index.html")
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			d.error(w, http.StatusNotFound)
+		} else {
+			d.error(w, http.StatusForbidden)
+		}
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		d.error(w, http.StatusNotFound)
+		return
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+// error serves the directory's own error page if it has one, otherwise one
+// formatted like the server we are imitating.
+func (d *decoy) error(w http.ResponseWriter, code int) {
+	if d.dir != "" {
+		if page, err := os.ReadFile(filepath.Join(d.dir, fmt.Sprintf("%d.html", code))); err == nil {
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(code)
+			w.Write(page)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, errorPage, code, http.StatusText(code), d.name())
+}
+
+func (d *decoy) name() string {
+	name := strings.SplitN(d.serverHeader, "/", 2)[0]
+	if name == "" {
+		name = DefaultServerHeader
+	}
+	return name
+}
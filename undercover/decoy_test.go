@@ -0,0 +1,159 @@
+package undercover
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/beefsack/go-under-cover/transport"
+)
+
+func TestDecoy(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"index.html":      "static index",
+		"about.txt":       "about us",
+		"docs/index.html": "docs index",
+		"404.html":        "custom not found",
+	}
+	for name, body := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0700)
+		if err := os.WriteFile(path, []byte(body), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/apache" {
+			w.Header().Set("Server", "Apache")
+		}
+		io.WriteString(w, "upstream "+r.URL.Path)
+	}))
+	defer upstream.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	tests := []struct {
+		name       string
+		dir        string
+		upstream   string
+		method     string
+		path       string
+		wantCode   int
+		wantServer string
+		wantBody   string
+	}{
+		{"default index", "", "", "GET", "/", 200, "nginx/1.18.0", "Welcome to nginx!"},
+		{"default not found", "", "", "GET", "/missing", 404, "nginx/1.18.0", "<center>nginx</center>"},
+		{"static index", dir, "", "GET", "/", 200, "nginx/1.18.0", "static index"},
+		{"static file", dir, "", "GET", "/about.txt", 200, "nginx/1.18.0", "about us"},
+		{"static directory index", dir, "", "GET", "/docs/", 200, "nginx/1.18.0", "docs index"},
+		{"static not found", dir, "", "GET", "/missing", 404, "nginx/1.18.0", "custom not found"},
+		{"static traversal", dir, "", "GET", "/../../etc/passwd", 404, "nginx/1.18.0", "custom not found"},
+		{"static post", dir, "", "POST", "/", 405, "nginx/1.18.0", "405 Method Not Allowed"},
+		{"upstream", "", upstream.URL, "GET", "/page", 200, "nginx/1.18.0", "upstream /page"},
+		{"upstream server header", "", upstream.URL, "GET", "/apache", 200, "Apache", "upstream /apache"},
+		{"upstream down", "", down.URL, "GET", "/", 502, "nginx/1.18.0", "502 Bad Gateway"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewDecoy(tt.dir, tt.upstream, "nginx/1.18.0")
+			if err != nil {
+				t.Fatalf("NewDecoy: %v", err)
+			}
+			w := httptest.NewRecorder()
+			d.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.wantCode {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantCode)
+			}
+			if server := w.Header().Get("Server"); server != tt.wantServer {
+				t.Errorf("got Server %q, want %q", server, tt.wantServer)
+			}
+			if body := w.Body.String(); !strings.Contains(body, tt.wantBody) {
+				t.Errorf("got body %q, want it to contain %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestNewDecoyErrors(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0600)
+	tests := []struct {
+		name     string
+		dir      string
+		upstream string
+	}{
+		{"missing dir", filepath.Join(t.TempDir(), "missing"), ""},
+		{"dir is a file", file, ""},
+		{"invalid upstream", "", "http://[::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewDecoy(tt.dir, tt.upstream, ""); err == nil {
+				t.Error("NewDecoy succeeded")
+			}
+		})
+	}
+}
+
+// TestDecoyHidesTunnel checks that requests to the tunnel path which aren't
+// WebSocket upgrades get the same response as any other missing page.
+func TestDecoyHidesTunnel(t *testing.T) {
+	decoy, err := NewDecoy("", "", DefaultServerHeader)
+	if err != nil {
+		t.Fatalf("NewDecoy: %v", err)
+	}
+	opts := DefaultServerOptions()
+	opts.Decoy = decoy
+	server, _ := startServer(t, opts)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	get := func(path string, header http.Header) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", "https://"+server.Addr().String()+path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res, string(body)
+	}
+	want, wantBody := get("/missing", nil)
+	tests := []struct {
+		name   string
+		header http.Header
+	}{
+		{"plain", nil},
+		{"websocket key without upgrade", http.Header{
+			"Sec-Websocket-Key":     {"dGhlIHNhbXBsZSBub25jZQ=="},
+			"Sec-Websocket-Version": {"13"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, body := get(transport.DefaultPath, tt.header)
+			if res.StatusCode != want.StatusCode {
+				t.Errorf("got status %d, want %d", res.StatusCode, want.StatusCode)
+			}
+			if server := res.Header.Get("Server"); server != DefaultServerHeader {
+				t.Errorf("got Server %q, want %q", server, DefaultServerHeader)
+			}
+			if body != wantBody {
+				t.Errorf("got body %q, want %q", body, wantBody)
+			}
+			if strings.Contains(strings.ToLower(body), "websocket") {
+				t.Errorf("body %q mentions websocket", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package undercover
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/beefsack/go-under-cover/bridge"
+	"github.com/beefsack/go-under-cover/llog"
+	"github.com/beefsack/go-under-cover/policy"
+	"github.com/beefsack/go-under-cover/socks"
+	"github.com/beefsack/go-under-cover/transport"
+)
+
+// Authorizer decides whether user may open a tunnel to address, which is
+// refused if it returns an error. Network is tcp, udp or bind.
+type Authorizer func(user, network, address string) error
+
+type ServerOptions struct {
+	Listen string
+	// CertFile and KeyFile are generated with a self-signed certificate if
+	// neither exists.
+	CertFile string
+	KeyFile  string
+	// Path, Subprotocol and BufferSize must match the clients'.
+	Path        string
+	Subprotocol string
+	BufferSize  int
+	// HandshakeTimeout limits the TLS and WebSocket handshakes, and
+	// DialTimeout connecting to destinations. Both are disabled if zero.
+	HandshakeTimeout time.Duration
+	DialTimeout      time.Duration
+	Bridge           *bridge.Options
+	// Auth verifies clients, who aren't authenticated if it is nil.
+	Auth transport.Verifier
+	// Policy restricts the destinations tunnels may reach.
+	Policy *policy.Policy
+	// Authorize, if set, is asked about every tunnel before Policy.
+	Authorize Authorizer
+	// Egress, if set, is an upstream SOCKS proxy tunnels are sent through
+	// rather than connecting directly. Domains are resolved locally to check
+	// them against Policy before the proxy is asked to connect to them, and
+	// refused if they can't be, unless EgressRemoteDNS is set to leave them
+	// for the proxy to resolve with only their ports checked. Bind isn't
+	// supported through it.
+	Egress          *socks.Client
+	EgressRemoteDNS bool
+	// Decoy serves requests which aren't tunnel requests.
+	Decoy  http.Handler
+	Logger *llog.Logger
+}
+
+func DefaultServerOptions() *ServerOptions {
+	return &ServerOptions{
+		Listen:           ":1443",
+		CertFile:         "cert.pem",
+		KeyFile:          "key.pem",
+		Path:             transport.DefaultPath,
+		Subprotocol:      transport.DefaultSubprotocol,
+		BufferSize:       transport.DefaultBufferSize,
+		HandshakeTimeout: transport.DefaultHandshakeTimeout,
+		Bridge:           bridge.DefaultOptions(),
+		Policy:           policy.New(),
+		Logger:           llog.Named("server"),
+	}
+}
+
+// Server accepts tunnels from clients and connects them to their
+// destinations.
+type Server struct {
+	opts *ServerOptions
+
+	mu   sync.Mutex
+	l    transport.Listener
+	done chan struct{}
+	err  error
+	// cancel ends the context tunnels are bridged with.
+	cancel context.CancelFunc
+}
+
+func NewServer(opts *ServerOptions) *Server {
+	if opts == nil {
+		opts = DefaultServerOptions()
+	}
+	return &Server{opts: opts}
+}
+
+// Start listens and serves tunnels in the background until Shutdown is
+// called or serving fails, which Wait reports.
+func (s *Server) Start(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	opts := s.opts
+	log := opts.Logger
+	if log == nil {
+		log = llog.Named("server")
+	}
+	_, keyErr := os.Stat(opts.KeyFile)
+	_, certErr := os.Stat(opts.CertFile)
+	if os.IsNotExist(keyErr) && os.IsNotExist(certErr) {
+		fingerprint, err := GenerateCert(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return err
+		}
+		log.Info("generated %s with fingerprint %s", opts.CertFile, fingerprint)
+	}
+
+	trans := transport.NewWSSPlain(opts.Listen)
+	trans.CertFile = opts.CertFile
+	trans.KeyFile = opts.KeyFile
+	trans.Path = opts.Path
+	trans.Subprotocol = opts.Subprotocol
+	trans.BufferSize = opts.BufferSize
+	trans.HandshakeTimeout = opts.HandshakeTimeout
+	trans.Auth = opts.Auth
+	trans.Fallback = opts.Decoy
+	l, err := trans.Listen()
+	if err != nil {
+		return fmt.Errorf("failed to start server: %v", err)
+	}
+
+	pol := opts.Policy
+	if pol == nil {
+		pol = policy.New()
+	}
+	hctx, cancel := context.WithCancel(context.Background())
+	h := &tunnelHandler{
+		ctx:       hctx,
+		policy:    pol,
+		authorize: opts.Authorize,
+		dialer: &net.Dialer{
+			Timeout: opts.DialTimeout,
+		},
+		egress:    opts.Egress,
+		remoteDNS: opts.EgressRemoteDNS,
+		lookupIP:  net.DefaultResolver.LookupIPAddr,
+		bridge:    opts.Bridge,
+		log:       log,
+	}
+	s.mu.Lock()
+	s.l = l
+	s.done = make(chan struct{})
+	s.cancel = cancel
+	s.mu.Unlock()
+	log.Info("listening on %s", l.Addr())
+	go s.serve(l, h)
+	return nil
+}
+
+func (s *Server) serve(l transport.Listener, h *tunnelHandler) {
+	defer close(s.done)
+	for {
+		conn, err := l.Accept()
+		if err == transport.ErrListenerClosed {
+			return
+		}
+		if err != nil {
+			s.err = fmt.Errorf("failed to accept tunnel: %v", err)
+			return
+		}
+		go h.handle(conn)
+	}
+}
+
+// Addr is the address the server is listening on, once started.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.l == nil {
+		return nil
+	}
+	return s.l.Addr()
+}
+
+// Wait blocks until the server stops, returning the error it failed with if
+// it wasn't stopped by Shutdown.
+func (s *Server) Wait() error {
+	s.mu.Lock()
+	done := s.done
+	s.mu.Unlock()
+	if done == nil {
+		return ErrNotStarted
+	}
+	<-done
+	return s.err
+}
+
+// Shutdown stops accepting tunnels and waits for open ones to finish, closing
+// any left once ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	l, cancel := s.l, s.cancel
+	s.mu.Unlock()
+	if l == nil {
+		return ErrNotStarted
+	}
+	defer cancel()
+	stop := cancelOnDone(ctx, cancel)
+	defer stop()
+	return l.Shutdown(ctx)
+}
+
+// cancelOnDone calls cancel once ctx is done, so bridges are ended with the
+// shutdown reason before their connections are closed, until stop is
+// called.
+func cancelOnDone(ctx context.Context, cancel context.CancelFunc) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
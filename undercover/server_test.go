@@ -0,0 +1,184 @@
+package undercover
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/beefsack/go-under-cover/policy"
+	"github.com/beefsack/go-under-cover/socks"
+	"github.com/beefsack/go-under-cover/transport"
+)
+
+// startServer runs a server on loopback with a new certificate, returning
+// the certificate's fingerprint. The server may reach loopback addresses.
+func startServer(t *testing.T, opts *ServerOptions) (*Server, string) {
+	t.Helper()
+	dir := t.TempDir()
+	opts.Listen = "127.0.0.1:0"
+	opts.CertFile = filepath.Join(dir, "cert.pem")
+	opts.KeyFile = filepath.Join(dir, "key.pem")
+	opts.Policy = policy.New()
+	opts.Policy.Allow = policy.MustParseCIDRs("127.0.0.0/8")
+	fingerprint, err := GenerateCert(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		t.Fatalf("GenerateCert: %v", err)
+	}
+	server := NewServer(opts)
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+	return server, fingerprint
+}
+
+// startTunnel runs a server with opts and a client using it on loopback,
+// returning both.
+func startTunnel(t *testing.T, opts *ServerOptions) (*Server, *Client) {
+	t.Helper()
+	server, fingerprint := startServer(t, opts)
+	trans := transport.NewWSSPlain(server.Addr().String())
+	trans.Fingerprint = fingerprint
+	clientOpts := DefaultClientOptions()
+	clientOpts.Listen = "127.0.0.1:0"
+	clientOpts.Transport = trans
+	client := NewClient(clientOpts)
+	if err := client.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start client: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		client.Shutdown(ctx)
+	})
+	return server, client
+}
+
+// echoServer echoes everything sent to it on loopback.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestNotStarted(t *testing.T) {
+	server := NewServer(nil)
+	client := NewClient(nil)
+	if err := server.Wait(); err != ErrNotStarted {
+		t.Errorf("server Wait returned %v, want ErrNotStarted", err)
+	}
+	if err := server.Shutdown(context.Background()); err != ErrNotStarted {
+		t.Errorf("server Shutdown returned %v, want ErrNotStarted", err)
+	}
+	if err := client.Wait(); err != ErrNotStarted {
+		t.Errorf("client Wait returned %v, want ErrNotStarted", err)
+	}
+	if err := client.Shutdown(context.Background()); err != ErrNotStarted {
+		t.Errorf("client Shutdown returned %v, want ErrNotStarted", err)
+	}
+	// The default options have no transport.
+	if err := client.Start(context.Background()); err == nil {
+		t.Error("client started without a transport")
+	}
+}
+
+func TestTunnel(t *testing.T) {
+	server, client := startTunnel(t, DefaultServerOptions())
+	echo := echoServer(t)
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from "+r.URL.Path)
+	}))
+	defer web.Close()
+
+	t.Run("socks", func(t *testing.T) {
+		conn, err := socks.NewClient(client.Addr().String(), socks.VerSocks5).Dial("tcp", echo)
+		if err != nil {
+			t.Fatalf("failed to dial through the tunnel: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("echo"))
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(conn, got); err != nil || string(got) != "echo" {
+			t.Errorf("got %q, %v", got, err)
+		}
+	})
+	t.Run("http", func(t *testing.T) {
+		proxy := &url.URL{Scheme: "http", Host: client.Addr().String()}
+		httpClient := &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyURL(proxy)},
+			Timeout:   5 * time.Second,
+		}
+		res, err := httpClient.Get(web.URL + "/page")
+		if err != nil {
+			t.Fatalf("failed to GET through the tunnel: %v", err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		if string(body) != "hello from /page" {
+			t.Errorf("got %q", body)
+		}
+		httpClient.CloseIdleConnections()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Shutdown(ctx); err != nil {
+		t.Errorf("client Shutdown: %v", err)
+	}
+	if err := client.Wait(); err != nil {
+		t.Errorf("client Wait: %v", err)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("server Shutdown: %v", err)
+	}
+	if err := server.Wait(); err != nil {
+		t.Errorf("server Wait: %v", err)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	echo := echoServer(t)
+	opts := DefaultServerOptions()
+	var asked string
+	opts.Authorize = func(user, network, address string) error {
+		asked = network + " " + address
+		return errors.New("not today")
+	}
+	_, client := startTunnel(t, opts)
+	_, err := socks.NewClient(client.Addr().String(), socks.VerSocks5).Dial("tcp", echo)
+	var replyErr *socks.ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Reply != socks.RepConnectionNotAllowedByRuleset {
+		t.Errorf("got %v, want the connection refused by ruleset", err)
+	}
+	if asked != "tcp "+echo {
+		t.Errorf("Authorize was asked about %q, want %q", asked, "tcp "+echo)
+	}
+}
@@ -0,0 +1,132 @@
+package undercover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/beefsack/go-under-cover/bridge"
+	"github.com/beefsack/go-under-cover/llog"
+	"github.com/beefsack/go-under-cover/metrics"
+	"github.com/beefsack/go-under-cover/route"
+	"github.com/beefsack/go-under-cover/session"
+	"github.com/beefsack/go-under-cover/socks"
+	"github.com/beefsack/go-under-cover/transport"
+)
+
+// socksHandler bridges SOCKS requests through trans until ctx is done.
+func socksHandler(
+	ctx context.Context,
+	trans transport.Transport,
+	opts *bridge.Options,
+	log *llog.Logger,
+) func(
+	ver socks.Version,
+	conn io.ReadWriter,
+	req *socks.Request,
+) error {
+	return func(ver socks.Version, conn io.ReadWriter, req *socks.Request) error {
+		// Log with the fields of the SOCKS connection all the way through
+		// the transport and bridge.
+		ctx, log := ctx, log
+		if req.Log != nil {
+			ctx = llog.NewContext(ctx, req.Log)
+			log = log.WithContext(ctx)
+		}
+		switch req.Cmd {
+		case socks.CmdUdpAddociate:
+			return udpAssociate(ctx, trans, udpIdleTimeout(opts), log, ver, conn, req)
+		case socks.CmdBind:
+			return bind(ctx, trans, opts, ver, conn, req)
+		}
+		dstConn, err := transport.DialContext(ctx, trans, "tcp", net.JoinHostPort(
+			req.DestAddr.String(),
+			strconv.Itoa(int(req.DestPort)),
+		))
+		if err != nil {
+			sendFailure(ver, conn, req, replyForError(err))
+			return fmt.Errorf("failed to dial transport: %v", err)
+		}
+		defer dstConn.Close()
+		res := &socks.Response{}
+		if sc, ok := dstConn.(transport.StatusConn); ok {
+			res = responseForStatus(sc.Status())
+		}
+		if err := ver.SendResponseHeader(conn, req, res); err != nil {
+			return fmt.Errorf("failed to send response header: %v", err)
+		}
+		sess := startSession(trans, "socks", conn, dstConn, req)
+		defer sess.Done()
+		result := bridge.Bridge(ctx, conn, sess.Wrap(dstConn), opts)
+		sess.End(result)
+		if err := result.Err(); err != nil {
+			return fmt.Errorf("failure during connection bridging: %v", err)
+		}
+		return nil
+	}
+}
+
+// startSession registers a SOCKS connection being bridged to dst.
+func startSession(
+	trans transport.Transport,
+	kind string,
+	conn io.ReadWriter,
+	dst io.ReadWriteCloser,
+	req *socks.Request,
+) *session.Session {
+	info := session.Info{
+		Kind:         kind,
+		SocksVersion: req.VersionName(),
+		ResolvedIP:   route.ResolvedIP(dst),
+		Destination: net.JoinHostPort(
+			req.DestAddr.String(),
+			strconv.Itoa(int(req.DestPort)),
+		),
+		User:      req.User,
+		Transport: route.Describe(trans, req.DestAddr.String(), req.DestPort),
+	}
+	closers := []io.Closer{dst}
+	if c, ok := conn.(net.Conn); ok {
+		info.Source = c.RemoteAddr().String()
+		closers = append(closers, c)
+	}
+	return session.Default.Start(info, closers...)
+}
+
+// sendFailure replies with rep, counting it as an error.
+func sendFailure(ver socks.Version, conn io.ReadWriter, req *socks.Request, rep byte) {
+	metrics.SocksErrorsTotal.Inc(socks.ReplyText(rep))
+	ver.SendResponseHeader(conn, req, &socks.Response{Reply: rep})
+}
+
+func responseForStatus(status *transport.Status) *socks.Response {
+	res := &socks.Response{}
+	if status.Host != "" {
+		res.BindAddr = socks.ParseAddr(status.Host)
+		res.BindPort = status.Port
+	}
+	return res
+}
+
+// replyForError maps a transport dial error to a SOCKS5 reply code. SOCKS4
+// versions map these down to their own codes.
+func replyForError(err error) byte {
+	var dialErr *transport.DialError
+	if !errors.As(err, &dialErr) {
+		return socks.RepGeneralSocksServerFailure
+	}
+	switch dialErr.Code {
+	case transport.StatusDenied:
+		return socks.RepConnectionNotAllowedByRuleset
+	case transport.StatusNetworkUnreachable:
+		return socks.RepNetworkUnreachable
+	case transport.StatusHostUnreachable, transport.StatusTimeout:
+		return socks.RepHostUnreachable
+	case transport.StatusRefused:
+		return socks.RepConnectionRefused
+	}
+	return socks.RepGeneralSocksServerFailure
+}
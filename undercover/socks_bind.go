@@ -0,0 +1,60 @@
+package undercover
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/beefsack/go-under-cover/bridge"
+	"github.com/beefsack/go-under-cover/socks"
+	"github.com/beefsack/go-under-cover/transport"
+)
+
+// bind has the server listen for a connection from the destination. The
+// client gets one reply with the address the server is listening on, and a
+// second once the destination has connected.
+func bind(
+	ctx context.Context,
+	trans transport.Transport,
+	opts *bridge.Options,
+	ver socks.Version,
+	conn io.ReadWriter,
+	req *socks.Request,
+) error {
+	dstConn, err := transport.DialContext(ctx, trans, "bind", net.JoinHostPort(
+		req.DestAddr.String(),
+		strconv.Itoa(int(req.DestPort)),
+	))
+	if err != nil {
+		sendFailure(ver, conn, req, replyForError(err))
+		return fmt.Errorf("failed to dial transport: %v", err)
+	}
+	defer dstConn.Close()
+	bc, ok := dstConn.(transport.BindConn)
+	if !ok {
+		sendFailure(ver, conn, req, socks.RepCommandNotSupported)
+		return fmt.Errorf("transport doesn't support BIND")
+	}
+
+	if err := ver.SendResponseHeader(conn, req, responseForStatus(bc.Status())); err != nil {
+		return fmt.Errorf("failed to send first response header: %v", err)
+	}
+	status, err := bc.Accept()
+	if err != nil {
+		sendFailure(ver, conn, req, replyForError(err))
+		return fmt.Errorf("failed to accept bind connection: %v", err)
+	}
+	if err := ver.SendResponseHeader(conn, req, responseForStatus(status)); err != nil {
+		return fmt.Errorf("failed to send second response header: %v", err)
+	}
+	sess := startSession(trans, "bind", conn, dstConn, req)
+	defer sess.Done()
+	result := bridge.Bridge(ctx, conn, sess.Wrap(dstConn), opts)
+	sess.End(result)
+	if err := result.Err(); err != nil {
+		return fmt.Errorf("failure during connection bridging: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package undercover
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/beefsack/go-under-cover/socks"
+	"github.com/beefsack/go-under-cover/transport"
+)
+
+func TestReplyForError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want byte
+	}{
+		{"denied", &transport.DialError{Code: transport.StatusDenied}, socks.RepConnectionNotAllowedByRuleset},
+		{"network", &transport.DialError{Code: transport.StatusNetworkUnreachable}, socks.RepNetworkUnreachable},
+		{"host", &transport.DialError{Code: transport.StatusHostUnreachable}, socks.RepHostUnreachable},
+		{"timeout", &transport.DialError{Code: transport.StatusTimeout}, socks.RepHostUnreachable},
+		{"refused", &transport.DialError{Code: transport.StatusRefused}, socks.RepConnectionRefused},
+		{"failure", &transport.DialError{Code: transport.StatusFailure}, socks.RepGeneralSocksServerFailure},
+		{"not a dial error", errors.New("tunnel down"), socks.RepGeneralSocksServerFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := replyForError(tt.err); got != tt.want {
+				t.Errorf("got %s, want %s", socks.ReplyText(got), socks.ReplyText(tt.want))
+			}
+		})
+	}
+}
+
+func TestResponseForStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   *transport.Status
+		wantAddr string
+		wantPort uint16
+	}{
+		{"ipv4", &transport.Status{Host: "198.51.100.7", Port: 40000}, "198.51.100.7", 40000},
+		{"ipv6", &transport.Status{Host: "2001:db8::7", Port: 1}, "2001:db8::7", 1},
+		{"empty", &transport.Status{}, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := responseForStatus(tt.status)
+			var addr string
+			if res.BindAddr != nil {
+				addr = res.BindAddr.String()
+			}
+			if addr != tt.wantAddr || res.BindPort != tt.wantPort {
+				t.Errorf("got %s:%d, want %s:%d", addr, res.BindPort, tt.wantAddr, tt.wantPort)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package undercover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/beefsack/go-under-cover/bridge"
+	"github.com/beefsack/go-under-cover/llog"
+	"github.com/beefsack/go-under-cover/socks"
+	"github.com/beefsack/go-under-cover/transport"
+)
+
+// udpAssociate relays datagrams between a local UDP socket and a "udp"
+// tunnel stream for as long as the SOCKS control connection stays open, or
+// until no datagram has been relayed for idle.
+func udpAssociate(
+	ctx context.Context,
+	trans transport.Transport,
+	idle time.Duration,
+	log *llog.Logger,
+	ver socks.Version,
+	conn io.ReadWriter,
+	req *socks.Request,
+) error {
+	ctrl, ok := conn.(net.Conn)
+	if !ok {
+		return errors.New("UDP ASSOCIATE needs a network connection")
+	}
+	remote, ok := ctrl.RemoteAddr().(*net.TCPAddr)
+	local, lok := ctrl.LocalAddr().(*net.TCPAddr)
+	if !ok || !lok {
+		sendFailure(ver, conn, req, socks.RepGeneralSocksServerFailure)
+		return fmt.Errorf("UDP ASSOCIATE needs a TCP connection, got %s", ctrl.RemoteAddr().Network())
+	}
+	clientIP := remote.IP
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		sendFailure(ver, conn, req, socks.RepGeneralSocksServerFailure)
+		return fmt.Errorf("failed to open UDP relay: %v", err)
+	}
+	defer relay.Close()
+
+	tunnel, err := transport.DialContext(ctx, trans, "udp", net.JoinHostPort(
+		req.DestAddr.String(),
+		strconv.Itoa(int(req.DestPort)),
+	))
+	if err != nil {
+		sendFailure(ver, conn, req, replyForError(err))
+		return fmt.Errorf("failed to dial transport: %v", err)
+	}
+	defer tunnel.Close()
+
+	bound := relay.LocalAddr().(*net.UDPAddr)
+	if err := ver.SendResponseHeader(conn, req, &socks.Response{
+		BindAddr: socks.ParseAddr(bound.IP.String()),
+		BindPort: uint16(bound.Port),
+	}); err != nil {
+		return fmt.Errorf("failed to send response header: %v", err)
+	}
+	log.Debug("relaying UDP for %s on %s", ctrl.RemoteAddr(), bound)
+	sess := startSession(trans, "udp", conn, tunnel, req)
+	defer sess.Done()
+
+	// The association ends when the client closes the control connection.
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		relay.Close()
+		tunnel.Close()
+	}()
+	timer := newIdleTimer(idle, func() {
+		ctrl.Close()
+		relay.Close()
+		tunnel.Close()
+	})
+	defer timer.Stop()
+
+	var (
+		clientMu   sync.Mutex
+		clientAddr *net.UDPAddr
+	)
+	go func() {
+		for {
+			host, port, data, err := transport.ReadPacket(tunnel)
+			if err != nil {
+				relay.Close()
+				return
+			}
+			clientMu.Lock()
+			dst := clientAddr
+			clientMu.Unlock()
+			if dst == nil {
+				continue
+			}
+			d := &socks.Datagram{
+				DestAddr: socks.ParseAddr(host),
+				DestPort: port,
+				Data:     data,
+			}
+			if _, err := relay.WriteToUDP(d.Encode(), dst); err != nil {
+				log.Debug("failed to send datagram to %s: %v", dst, err)
+				continue
+			}
+			timer.Touch()
+			sess.Down(len(data))
+		}
+	}()
+
+	reassembler := socks.NewReassembler()
+	buf := make([]byte, 65535)
+	for {
+		n, src, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			if timer.Expired() {
+				log.Debug("closing UDP association after idling for %s", idle)
+				err = bridge.ErrIdleTimeout
+			} else {
+				err = nil
+			}
+			sess.EndErr(err)
+			return nil
+		}
+		if !src.IP.Equal(clientIP) {
+			log.Debug("dropping datagram from unexpected source %s", src)
+			continue
+		}
+		clientMu.Lock()
+		clientAddr = src
+		clientMu.Unlock()
+
+		d, err := socks.ParseDatagram(buf[:n])
+		if err != nil {
+			log.Debug("dropping invalid datagram from %s: %v", src, err)
+			continue
+		}
+		if d = reassembler.Add(d, time.Now()); d == nil {
+			continue
+		}
+		if err := transport.WritePacket(
+			tunnel,
+			d.DestAddr.String(),
+			d.DestPort,
+			d.Data,
+		); err != nil {
+			err = fmt.Errorf("failed to send datagram through tunnel: %v", err)
+			sess.EndErr(err)
+			return err
+		}
+		timer.Touch()
+		sess.Up(len(d.Data))
+	}
+}
@@ -0,0 +1,161 @@
+package undercover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/beefsack/go-under-cover/bridge"
+	"github.com/beefsack/go-under-cover/llog"
+	"github.com/beefsack/go-under-cover/metrics"
+	"github.com/beefsack/go-under-cover/policy"
+	"github.com/beefsack/go-under-cover/session"
+	"github.com/beefsack/go-under-cover/socks"
+	"github.com/beefsack/go-under-cover/transport"
+)
+
+type tunnelHandler struct {
+	// ctx is done once the server is shut down.
+	ctx       context.Context
+	policy    *policy.Policy
+	authorize Authorizer
+	dialer    *net.Dialer
+	egress    *socks.Client
+	// remoteDNS leaves domains which can't be resolved locally for the
+	// egress proxy to resolve.
+	remoteDNS bool
+	lookupIP  func(ctx context.Context, host string) ([]net.IPAddr, error)
+	bridge    *bridge.Options
+	log       *llog.Logger
+}
+
+func (h *tunnelHandler) handle(conn *transport.Conn) {
+	defer conn.Close()
+	address := net.JoinHostPort(conn.Host, conn.Port)
+	log := h.log.With(
+		llog.F("remote", conn.RemoteAddr.String()),
+		llog.F("user", conn.User),
+		llog.F("dest", address),
+	)
+	ctx := llog.NewContext(h.ctx, log)
+	if h.authorize != nil {
+		if err := h.authorize(conn.User, conn.Network, address); err != nil {
+			log.Warn("refusing %s to %s: %v", conn.Network, address, err)
+			conn.Reply(&transport.Status{Code: transport.StatusDenied})
+			return
+		}
+	}
+	switch conn.Network {
+	case "udp":
+		h.handleUDP(ctx, conn, log)
+		return
+	case "bind":
+		if h.egress != nil {
+			log.Warn("refusing bind to %s through egress proxy", address)
+			conn.Reply(&transport.Status{Code: transport.StatusFailure})
+			return
+		}
+		h.handleBind(ctx, conn, log)
+		return
+	}
+	log.Debug("tunnel from %s to %s", conn.RemoteAddr, address)
+
+	start := time.Now()
+	target, err := h.dial(ctx, conn.User, address)
+	if err != nil {
+		log.Warn("failed to dial %s: %v", address, err)
+		code := statusForError(err)
+		metrics.DialErrorsTotal.Inc(transport.StatusText(code))
+		if err := conn.Reply(&transport.Status{Code: code}); err != nil {
+			log.Debug("failed to send status to %s: %v", conn.RemoteAddr, err)
+		}
+		return
+	}
+	defer target.Close()
+	metrics.DialSeconds.ObserveSince(start, "target")
+	if err := conn.Reply(transport.StatusForAddr(target.LocalAddr())); err != nil {
+		log.Warn("failed to send status to %s: %v", conn.RemoteAddr, err)
+		return
+	}
+
+	info := session.Info{
+		Kind:        "tunnel",
+		Source:      conn.RemoteAddr.String(),
+		Destination: address,
+		User:        conn.User,
+		Transport:   "direct",
+	}
+	if h.egress == nil {
+		info.ResolvedIP, _, _ = net.SplitHostPort(target.RemoteAddr().String())
+	} else {
+		info.Transport = "socks"
+		if net.ParseIP(conn.Host) != nil {
+			info.ResolvedIP = conn.Host
+		}
+	}
+	sess := session.Default.Start(info, conn, target)
+	defer sess.Done()
+	result := bridge.Bridge(ctx, conn, sess.Wrap(target), h.bridge)
+	sess.End(result)
+	if err := result.Err(); err != nil {
+		log.Debug("failure during connection bridging: %v", err)
+	}
+}
+
+// dial connects to address directly, or through the egress proxy if there
+// is one.
+func (h *tunnelHandler) dial(ctx context.Context, user, address string) (net.Conn, error) {
+	if h.egress == nil {
+		return h.policy.Dialer(user, h.dialer).Dial("tcp", address)
+	}
+	if h.dialer.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.dialer.Timeout)
+		defer cancel()
+	}
+	if err := h.checkEgress(ctx, user, address); err != nil {
+		return nil, err
+	}
+	return h.egress.DialContext(ctx, "tcp", address)
+}
+
+// checkEgress checks an address being sent to the egress proxy against the
+// policy. Domains are resolved so every address they resolve to can be
+// checked, and are refused if they can't be unless remoteDNS is set, when
+// only their port is checked.
+func (h *tunnelHandler) checkEgress(ctx context.Context, user, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if net.ParseIP(host) != nil {
+		return h.policy.CheckAddr(user, address)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %s", portStr)
+	}
+	ips, err := h.lookupIP(ctx, host)
+	if err != nil || len(ips) == 0 {
+		if h.remoteDNS {
+			return h.policy.CheckPort(user, uint16(port))
+		}
+		return fmt.Errorf("%w: failed to resolve %s: %v", policy.ErrDenied, host, err)
+	}
+	for _, ip := range ips {
+		if err := h.policy.Check(user, ip.IP, uint16(port)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func statusForError(err error) byte {
+	if errors.Is(err, policy.ErrDenied) {
+		return transport.StatusDenied
+	}
+	return transport.StatusForError(err)
+}
@@ -0,0 +1,92 @@
+package undercover
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/beefsack/go-under-cover/bridge"
+	"github.com/beefsack/go-under-cover/llog"
+	"github.com/beefsack/go-under-cover/session"
+	"github.com/beefsack/go-under-cover/transport"
+)
+
+const bindTimeout = 2 * time.Minute
+
+// handleBind listens for a single inbound connection from the requested
+// host, sending one status once listening and another once the connection
+// arrives.
+func (h *tunnelHandler) handleBind(ctx context.Context, conn *transport.Conn, log *llog.Logger) {
+	address := net.JoinHostPort(conn.Host, conn.Port)
+	// Listen on the address we'd use to reach the peer, so the address
+	// reported to the client is one the peer can connect to.
+	var bindIP string
+	if probe, err := net.Dial("udp", address); err == nil {
+		if addr, ok := probe.LocalAddr().(*net.UDPAddr); ok {
+			bindIP = addr.IP.String()
+		}
+		probe.Close()
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(bindIP, "0"))
+	if err != nil {
+		log.Warn("failed to listen for bind: %v", err)
+		conn.Reply(&transport.Status{Code: statusForError(err)})
+		return
+	}
+	defer ln.Close()
+	if err := conn.Reply(transport.StatusForAddr(ln.Addr())); err != nil {
+		log.Warn("failed to send status to %s: %v", conn.RemoteAddr, err)
+		return
+	}
+	log.Debug("bound %s for %s", ln.Addr(), address)
+
+	if tl, ok := ln.(*net.TCPListener); ok {
+		tl.SetDeadline(time.Now().Add(bindTimeout))
+	}
+	peer, err := ln.Accept()
+	if err != nil {
+		log.Debug("failed to accept bind connection: %v", err)
+		conn.Reply(&transport.Status{Code: statusForError(err)})
+		return
+	}
+	defer peer.Close()
+	ln.Close()
+
+	peerAddr, ok := peer.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		log.Warn("rejecting bind connection from unexpected address %s", peer.RemoteAddr())
+		conn.Reply(&transport.Status{Code: transport.StatusFailure})
+		return
+	}
+	expected := net.ParseIP(conn.Host)
+	peerIP := peerAddr.IP
+	if expected != nil && !expected.IsUnspecified() && !expected.Equal(peerIP) {
+		log.Warn("rejecting bind connection from %s, expected %s", peerIP, expected)
+		conn.Reply(&transport.Status{Code: transport.StatusDenied})
+		return
+	}
+	if err := h.policy.CheckAddr(conn.User, peer.RemoteAddr().String()); err != nil {
+		log.Warn("rejecting bind connection from %s: %v", peerIP, err)
+		conn.Reply(&transport.Status{Code: transport.StatusDenied})
+		return
+	}
+	if err := conn.Reply(transport.StatusForAddr(peer.RemoteAddr())); err != nil {
+		log.Warn("failed to send status to %s: %v", conn.RemoteAddr, err)
+		return
+	}
+
+	sess := session.Default.Start(session.Info{
+		Kind:        "bind",
+		Source:      conn.RemoteAddr.String(),
+		Destination: address,
+		User:        conn.User,
+		ResolvedIP:  peerIP.String(),
+		Transport:   "direct",
+	}, conn, peer)
+	defer sess.Done()
+	result := bridge.Bridge(ctx, conn, sess.Wrap(peer), h.bridge)
+	sess.End(result)
+	if err := result.Err(); err != nil {
+		log.Debug("failure during connection bridging: %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package undercover
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/beefsack/go-under-cover/socks"
+)
+
+// readSocks5Reply reads a SOCKS5 reply with an IPv4 address.
+func readSocks5Reply(t *testing.T, conn net.Conn) (byte, *net.TCPAddr) {
+	t.Helper()
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	if reply[0] != socks.VerSocks5 || reply[3] != socks.ATypIPv4 {
+		t.Fatalf("unexpected reply % x", reply)
+	}
+	return reply[1], &net.TCPAddr{
+		IP:   net.IP(reply[4:8]),
+		Port: int(reply[8])<<8 | int(reply[9]),
+	}
+}
+
+func TestBind(t *testing.T) {
+	tests := []struct {
+		name      string
+		peerIP    string
+		wantReply byte
+	}{
+		{"expected peer", "127.0.0.2", socks.RepSucceeded},
+		{"unexpected peer", "127.0.0.3", socks.RepConnectionNotAllowedByRuleset},
+	}
+	_, client := startTunnel(t, DefaultServerOptions())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", client.Addr().String())
+			if err != nil {
+				t.Fatalf("failed to dial client: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			conn.Write([]byte{socks.VerSocks5, 1, socks.MethodNoAuth})
+			if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+				t.Fatalf("failed to read method: %v", err)
+			}
+			// Only connections from 127.0.0.2 are expected.
+			conn.Write([]byte{socks.VerSocks5, socks.CmdBind, 0x00, socks.ATypIPv4, 127, 0, 0, 2, 0, 1})
+
+			rep, listening := readSocks5Reply(t, conn)
+			if rep != socks.RepSucceeded || listening.Port == 0 {
+				t.Fatalf("first reply was %s listening on %s", socks.ReplyText(rep), listening)
+			}
+			if listening.IP.IsUnspecified() {
+				listening.IP = net.IPv4(127, 0, 0, 1)
+			}
+			dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(tt.peerIP)}}
+			peer, err := dialer.Dial("tcp", listening.String())
+			if err != nil {
+				t.Fatalf("failed to connect to %s: %v", listening, err)
+			}
+			defer peer.Close()
+
+			rep, from := readSocks5Reply(t, conn)
+			if rep != tt.wantReply {
+				t.Fatalf("second reply was %s, want %s", socks.ReplyText(rep), socks.ReplyText(tt.wantReply))
+			}
+			if rep != socks.RepSucceeded {
+				return
+			}
+			if from.String() != peer.LocalAddr().String() {
+				t.Errorf("second reply has peer %s, want %s", from, peer.LocalAddr())
+			}
+			peer.Write([]byte("hello"))
+			got := make([]byte, 5)
+			if _, err := io.ReadFull(conn, got); err != nil || string(got) != "hello" {
+				t.Errorf("got %q, %v", got, err)
+			}
+		})
+	}
+}
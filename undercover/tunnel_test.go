@@ -0,0 +1,62 @@
+package undercover
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/beefsack/go-under-cover/policy"
+)
+
+func TestCheckEgress(t *testing.T) {
+	hosts := map[string][]net.IPAddr{
+		"example.com":  {{IP: net.ParseIP("93.184.216.34")}},
+		"internal":     {{IP: net.ParseIP("10.0.0.1")}},
+		"mixed":        {{IP: net.ParseIP("93.184.216.34")}, {IP: net.ParseIP("127.0.0.1")}},
+		"unresolvable": nil,
+	}
+	lookupIP := func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		ips, ok := hosts[host]
+		if !ok {
+			return nil, errors.New("no such host")
+		}
+		return ips, nil
+	}
+	pol := policy.New()
+	pol.Ports = []policy.PortRange{{From: 80, To: 443}}
+	tests := []struct {
+		name      string
+		address   string
+		remoteDNS bool
+		allowed   bool
+	}{
+		{"public ip", "93.184.216.34:443", false, true},
+		{"private ip", "10.0.0.1:443", false, false},
+		{"public domain", "example.com:443", false, true},
+		{"private domain", "internal:443", false, false},
+		{"any private address", "mixed:443", false, false},
+		{"port not allowed", "example.com:22", false, false},
+		{"unresolved", "example.onion:443", false, false},
+		{"no addresses", "unresolvable:443", false, false},
+		{"remote dns", "example.onion:443", true, true},
+		{"remote dns port not allowed", "example.onion:22", true, false},
+		{"remote dns still resolves", "internal:443", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &tunnelHandler{
+				policy:    pol,
+				remoteDNS: tt.remoteDNS,
+				lookupIP:  lookupIP,
+			}
+			err := h.checkEgress(context.Background(), "", tt.address)
+			if allowed := err == nil; allowed != tt.allowed {
+				t.Fatalf("got %v, want allowed %v", err, tt.allowed)
+			}
+			if err != nil && !errors.Is(err, policy.ErrDenied) {
+				t.Errorf("error %v doesn't wrap ErrDenied", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package undercover
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/beefsack/go-under-cover/bridge"
+	"github.com/beefsack/go-under-cover/llog"
+	"github.com/beefsack/go-under-cover/session"
+	"github.com/beefsack/go-under-cover/transport"
+)
+
+// handleUDP relays datagrams framed on the tunnel stream through a UDP
+// socket on the server, or an association with the egress proxy, until the
+// stream closes or no datagram has been relayed for the idle timeout.
+func (h *tunnelHandler) handleUDP(ctx context.Context, conn *transport.Conn, log *llog.Logger) {
+	var (
+		pc  net.PacketConn
+		err error
+	)
+	if h.egress != nil {
+		pc, err = h.egress.ListenPacket(ctx)
+	} else {
+		pc, err = net.ListenUDP("udp", nil)
+	}
+	if err != nil {
+		log.Warn("failed to open UDP socket: %v", err)
+		conn.Reply(&transport.Status{Code: statusForError(err)})
+		return
+	}
+	defer pc.Close()
+	if err := conn.Reply(transport.StatusForAddr(pc.LocalAddr())); err != nil {
+		log.Warn("failed to send status to %s: %v", conn.RemoteAddr, err)
+		return
+	}
+	info := session.Info{
+		Kind:        "udp",
+		Source:      conn.RemoteAddr.String(),
+		Destination: net.JoinHostPort(conn.Host, conn.Port),
+		User:        conn.User,
+		Transport:   "direct",
+	}
+	if h.egress != nil {
+		info.Transport = "socks"
+	}
+	sess := session.Default.Start(info, conn, pc)
+	defer sess.Done()
+	idle := udpIdleTimeout(h.bridge)
+	timer := newIdleTimer(idle, func() {
+		conn.Close()
+		pc.Close()
+	})
+	defer timer.Stop()
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, src, err := pc.ReadFrom(buf)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			host, portStr, err := net.SplitHostPort(src.String())
+			if err != nil {
+				continue
+			}
+			port, _ := strconv.ParseUint(portStr, 10, 16)
+			if err := transport.WritePacket(
+				conn,
+				host,
+				uint16(port),
+				buf[:n],
+			); err != nil {
+				pc.Close()
+				return
+			}
+			timer.Touch()
+			sess.Down(n)
+		}
+	}()
+
+	for {
+		host, port, data, err := transport.ReadPacket(conn)
+		if err != nil {
+			switch {
+			case timer.Expired():
+				log.Debug("closing UDP association after idling for %s", idle)
+				err = bridge.ErrIdleTimeout
+			case errors.Is(err, io.EOF):
+				err = nil
+			}
+			sess.EndErr(err)
+			return
+		}
+		addr, err := h.udpAddr(ctx, conn.User, host, port)
+		if err != nil {
+			log.Debug("dropping datagram to %s: %v", host, err)
+			continue
+		}
+		if _, err := pc.WriteTo(data, addr); err != nil {
+			log.Debug("failed to send datagram to %s: %v", addr, err)
+			continue
+		}
+		timer.Touch()
+		sess.Up(len(data))
+	}
+}
+
+// udpAddr resolves and checks where to send a datagram. Domains are still
+// sent to the egress proxy by name if there is one, once checked.
+func (h *tunnelHandler) udpAddr(ctx context.Context, user, host string, port uint16) (net.Addr, error) {
+	address := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	if h.egress != nil {
+		if err := h.checkEgress(ctx, user, address); err != nil {
+			return nil, err
+		}
+		return &transport.Addr{Net: "udp", Address: address}, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.policy.CheckAddr(user, addr.String()); err != nil {
+		return nil, err
+	}
+	return addr, nil
+}
@@ -0,0 +1,54 @@
+package undercover
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/beefsack/go-under-cover/bridge"
+)
+
+// udpIdleTimeout is the idle timeout for UDP associations, which is the
+// same as for bridges.
+func udpIdleTimeout(opts *bridge.Options) time.Duration {
+	if opts == nil {
+		return bridge.DefaultIdleTimeout
+	}
+	return opts.IdleTimeout
+}
+
+// idleTimer calls expire once nothing has touched it for timeout, to end UDP
+// associations which have no connection to close. A zero timeout never
+// expires.
+type idleTimer struct {
+	timer   *time.Timer
+	timeout time.Duration
+	expired int32
+}
+
+func newIdleTimer(timeout time.Duration, expire func()) *idleTimer {
+	t := &idleTimer{timeout: timeout}
+	if timeout > 0 {
+		t.timer = time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&t.expired, 1)
+			expire()
+		})
+	}
+	return t
+}
+
+// Touch restarts the timeout, and should be called for each datagram.
+func (t *idleTimer) Touch() {
+	if t.timer != nil {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+func (t *idleTimer) Stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+func (t *idleTimer) Expired() bool {
+	return atomic.LoadInt32(&t.expired) == 1
+}
@@ -0,0 +1,41 @@
+package undercover
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdleTimer(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		touches int
+		want    bool
+	}{
+		{"expires", 20 * time.Millisecond, 0, true},
+		{"touched", 50 * time.Millisecond, 5, false},
+		{"disabled", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expired := make(chan struct{})
+			timer := newIdleTimer(tt.timeout, func() { close(expired) })
+			defer timer.Stop()
+			for i := 0; i < tt.touches; i++ {
+				time.Sleep(tt.timeout / 2)
+				timer.Touch()
+			}
+			if tt.want {
+				select {
+				case <-expired:
+				case <-time.After(time.Second):
+				}
+			} else {
+				time.Sleep(tt.timeout/2 + 10*time.Millisecond)
+			}
+			if timer.Expired() != tt.want {
+				t.Errorf("expired is %v, want %v", timer.Expired(), tt.want)
+			}
+		})
+	}
+}